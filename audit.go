@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// AuditEvent is published to --audit-topic on every token lifecycle change.
+type AuditEvent struct {
+	Action    string    `json:"action"`
+	User      string    `json:"user"`
+	Token     string    `json:"token"`
+	Caller    string    `json:"caller"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// tokenRef returns an identifier for doc that is safe to log: the stored hash for
+// hashed tokens and the hash of the id for raw ones, so no live secret leaks out.
+func tokenRef(doc interface{}) string {
+	id := ei.N(doc).M("id").StringZ()
+	if ei.N(doc).M("alg").StringZ() == hashAlg {
+		return id
+	}
+	return hashToken(id)
+}
+
+// audit publishes a token lifecycle event. It is a no-op without --audit-topic,
+// and publish failures are logged without failing the calling operation.
+func audit(task *nxsugar.Task, action string, user string, ref string) {
+	if opts.AuditTopic == "" {
+		return
+	}
+	ev := &AuditEvent{
+		Action:    action,
+		User:      user,
+		Token:     ref,
+		Caller:    task.User,
+		Timestamp: time.Now(),
+	}
+	go func() {
+		if _, err := task.GetConn().TopicPublish(opts.AuditTopic, ev); err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error publishing audit event: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// tokenCache keeps an in-memory copy of unlimited (negative ttl) tokens, kept fresh
+// through a RethinkDB changefeed. Logins with these tokens never decrement ttl, so
+// they can be validated locally without risking a double spend. Tokens with
+// max_uses count their logins and are left out. lastSeen updates
+// are batched and flushed to the database asynchronously. Only the default table is
+// cached; tenant logins always go to the database.
+type tokenCache struct {
+	sync.RWMutex
+	ready  bool
+	tokens map[string]map[string]interface{}
+
+	seenLock sync.Mutex
+	seen     map[string]struct{}
+}
+
+var cache *tokenCache
+
+const (
+	cacheRetryDelay    = 5 * time.Second
+	cacheFlushInterval = 5 * time.Second
+)
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		tokens: make(map[string]map[string]interface{}),
+		seen:   make(map[string]struct{}),
+	}
+}
+
+// run follows the changefeed forever, rebuilding the cache whenever the feed breaks.
+func (c *tokenCache) run() {
+	go c.flushSeen()
+	for {
+		if err := c.follow(); err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Token cache changefeed error: %v", err)
+		}
+		c.Lock()
+		c.ready = false
+		c.tokens = make(map[string]map[string]interface{})
+		c.Unlock()
+		time.Sleep(cacheRetryDelay)
+	}
+}
+
+func (c *tokenCache) follow() error {
+	cur, err := r.Table(defaultTable).
+		Filter(r.Row.Field("ttl").Lt(0).And(r.Row.HasFields("max_uses").Not())).
+		Changes(r.ChangesOpts{IncludeInitial: true, IncludeStates: true}).
+		Run(db)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+
+	var change struct {
+		NewValue map[string]interface{} `gorethink:"new_val"`
+		OldValue map[string]interface{} `gorethink:"old_val"`
+		State    string                 `gorethink:"state"`
+	}
+	for cur.Next(&change) {
+		c.Lock()
+		switch {
+		case change.State == "ready":
+			c.ready = true
+			srv.Log(nxsugar.InfoLevel, "Token cache ready")
+		case change.NewValue != nil:
+			c.tokens[ei.N(change.NewValue).M("id").StringZ()] = change.NewValue
+		case change.OldValue != nil:
+			delete(c.tokens, ei.N(change.OldValue).M("id").StringZ())
+		}
+		change.NewValue, change.OldValue, change.State = nil, nil, ""
+		c.Unlock()
+	}
+	return cur.Err()
+}
+
+// login validates an unlimited token stored under key. ok is false when the cache
+// can't answer and the caller must fall back to the database.
+func (c *tokenCache) login(key string) (doc map[string]interface{}, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.ready {
+		return nil, false
+	}
+	cached, found := c.tokens[key]
+	if !found {
+		return nil, false
+	}
+	deadline, err := ei.N(cached).M("deadline").Time()
+	if err != nil || deadline.Before(time.Now()) {
+		return nil, false
+	}
+
+	doc = make(map[string]interface{}, len(cached))
+	for k, v := range cached {
+		doc[k] = v
+	}
+	doc["lastSeen"] = time.Now()
+
+	c.seenLock.Lock()
+	c.seen[key] = struct{}{}
+	c.seenLock.Unlock()
+	return doc, true
+}
+
+// flushSeen periodically writes lastSeen for tokens used through the cache.
+func (c *tokenCache) flushSeen() {
+	for range time.Tick(cacheFlushInterval) {
+		c.seenLock.Lock()
+		keys := make([]interface{}, 0, len(c.seen))
+		for key := range c.seen {
+			keys = append(keys, key)
+		}
+		c.seen = make(map[string]struct{})
+		c.seenLock.Unlock()
+
+		if len(keys) == 0 {
+			continue
+		}
+		_, err := r.Table(defaultTable).GetAll(keys...).Update(ei.M{"lastSeen": r.Now()}).RunWrite(db)
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error flushing cached token lastSeen: %v", err)
+		}
+	}
+}
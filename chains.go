@@ -0,0 +1,134 @@
+package main
+
+import (
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// Tokens created with the parent param keep the key of their parent token in the
+// parent field. Revoking or consuming a token revokes its live descendants, so
+// revoking a session kills every sub-token delegated from it.
+
+// maxChainDepth bounds how many generations a cascade walks down. Chains can't loop
+// through create, as a child is always newer than its parent, but imported documents
+// could.
+const maxChainDepth = 32
+
+// parentKey validates the parent param of create and returns the key to store in the
+// parent field, or an empty key without the param. The parent must be live and the
+// caller must be allowed to create tokens for its owner.
+func parentKey(task *nxsugar.Task, params interface{}) (string, *nxsugar.JsonRpcErr) {
+	raw := ei.N(params).M("parent").RawZ()
+	if raw == nil {
+		return "", nil
+	}
+	parent, ok := raw.(string)
+	if !ok || parent == "" {
+		return "", &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "parent must be a non-empty string"}
+	}
+	key := tokenKey(parent)
+	doc, jerr := getToken(task, key)
+	if jerr != nil {
+		return "", jerr
+	}
+	live := !tombstoned(doc) && tokenStatus(doc, time.Now()).Live
+	if !tokenMatches(doc, parent) || !live {
+		return "", &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid parent token"}
+	}
+	if jerr := checkTokenOwner(task, doc, "@sys.login.token.create"); jerr != nil {
+		return "", jerr
+	}
+	return key, nil
+}
+
+// revokeChildren revokes the live descendants of the tokens stored under keys,
+// one generation at a time, and returns how many were revoked. Revoked tokens are
+// no longer live, so no token is revoked twice even if chains loop.
+func revokeChildren(task *nxsugar.Task, keys ...interface{}) (int, error) {
+	revoked := 0
+	for depth := 0; len(keys) > 0 && depth < maxChainDepth; depth++ {
+		ret, err := activeTokens(tokensTable(task).GetAllByIndex("parent", keys...)).
+			Update(revocation(), r.UpdateOpts{ReturnChanges: true}).
+			RunWrite(db)
+		if err != nil {
+			return revoked, err
+		}
+		keys = keys[:0]
+		for _, change := range ret.Changes {
+			keys = append(keys, ei.N(change.NewValue).M("id").StringZ())
+		}
+		revoked += len(ret.Changes)
+	}
+	if len(keys) > 0 {
+		srv.Log(nxsugar.WarnLevel, "Token chain deeper than %d, descendants left live", maxChainDepth)
+	}
+	return revoked, nil
+}
+
+// cascadeRevocation revokes the descendants of the tokens stored under keys after
+// they were revoked or consumed.
+func cascadeRevocation(task *nxsugar.Task, keys ...interface{}) *nxsugar.JsonRpcErr {
+	if len(keys) == 0 {
+		return nil
+	}
+	n, err := revokeChildren(task, keys...)
+	if err != nil {
+		return dbError(err)
+	}
+	if n > 0 {
+		srv.Log(nxsugar.InfoLevel, "Child tokens revoked by %s: %d", task.User, n)
+	}
+	return nil
+}
+
+// reparentChildren points the children of the token stored under oldKey to newKey
+// once refresh or rotate_secret moved it. The new token has already been handed out
+// by then, so a failure is only logged.
+func reparentChildren(task *nxsugar.Task, oldKey, newKey string) {
+	_, err := tokensTable(task).GetAllByIndex("parent", oldKey).Update(ei.M{"parent": newKey}).RunWrite(db)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error moving child tokens to their new parent: %v", err)
+	}
+}
+
+// childrenHandler returns the tokens created with the token param as their parent,
+// whatever their status. The caller needs to own the parent or hold @admin or listTag
+// over its user.
+func childrenHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	key := tokenKey(token)
+	doc, jerr := getToken(task, key)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if !tokenMatches(doc, token) {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+	if jerr := checkTokenOwner(task, doc, listTag); jerr != nil {
+		return nil, jerr
+	}
+
+	res, err := tokensTable(task).GetAllByIndex("parent", key).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	tokens := []interface{}{}
+	if err := res.All(&tokens); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	if jerr := decryptTokens(tokens); jerr != nil {
+		return nil, jerr
+	}
+	return tokens, nil
+}
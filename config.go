@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// defaultTTL is the ttl of tokens created, or refreshed, without one.
+var defaultTTL = 1
+
+// TokenAuthConfig is the optional tokenauth section of the nexus config file, which
+// holds the service defaults, the method prefix and the JSON schema of token
+// metadata. Durations are strings such as "24h". Flags given on the command line or
+// through the environment take precedence over it.
+type TokenAuthConfig struct {
+	DefaultTTL      *int   `json:"default_ttl"`
+	DefaultDeadline string `json:"default_deadline"`
+	OTPTTL          *int   `json:"otp_ttl"`
+	OTPLifetime     string `json:"otp_lifetime"`
+	CleanupInterval string `json:"cleanup_interval"`
+	MethodPrefix    string `json:"method_prefix"`
+
+	MetadataSchema json.RawMessage `json:"metadata_schema"`
+}
+
+// loadTokenAuthConfig applies the tokenauth section of the config file, if any, to
+// the defaults the parser didn't get explicitly.
+func loadTokenAuthConfig(parser *flags.Parser) error {
+	data, err := ioutil.ReadFile(opts.Config)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var file struct {
+		TokenAuth *TokenAuthConfig `json:"tokenauth"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	cfg := file.TokenAuth
+	if cfg == nil {
+		return nil
+	}
+
+	// go-flags reports options filled from their default tag, or from the environment
+	// through it, as set too. Only the command line and the environment win over the file.
+	unset := func(name string) bool {
+		option := parser.FindOptionByLongName(name)
+		if option == nil {
+			return true
+		}
+		if key := option.EnvKeyWithNamespace(); key != "" {
+			if _, ok := os.LookupEnv(key); ok {
+				return false
+			}
+		}
+		return !option.IsSet() || option.IsSetDefault()
+	}
+	if cfg.DefaultTTL != nil {
+		defaultTTL = *cfg.DefaultTTL
+	}
+	if len(cfg.MetadataSchema) > 0 {
+		if err := loadMetadataSchema(cfg.MetadataSchema); err != nil {
+			return err
+		}
+	}
+	if cfg.MethodPrefix != "" && unset("method-prefix") {
+		opts.MethodPrefix = cfg.MethodPrefix
+	}
+	if cfg.OTPTTL != nil && unset("otp-ttl") {
+		opts.OTPTTL = *cfg.OTPTTL
+	}
+	durations := []struct {
+		flag  string
+		value string
+		dst   *time.Duration
+	}{
+		{"default-deadline", cfg.DefaultDeadline, &opts.DefaultDeadline},
+		{"otp-lifetime", cfg.OTPLifetime, &opts.OTPLifetime},
+		{"cleanup-interval", cfg.CleanupInterval, &opts.CleanupInterval},
+	}
+	for _, d := range durations {
+		if d.value == "" || !unset(d.flag) {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return err
+		}
+		*d.dst = v
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// methods lists the methods registered by addMethod, in registration order.
+var methods []string
+
+// permissionTags maps the actions guarded by a dedicated tag to that tag. @admin
+// grants all of them.
+var permissionTags = map[string]string{
+	"create": "@sys.login.token.create",
+	"list":   listTag,
+	"renew":  "@sys.login.token.renew",
+	"revoke": "@sys.login.token.revoke",
+	"rotate": "@sys.login.token.rotate",
+	"stats":  "@sys.login.token.stats",
+	"update": "@sys.login.token.update",
+}
+
+// DescribeResponse is the capabilities document returned by describe. Durations
+// are in seconds, with 0 meaning disabled. It never holds credentials or keys.
+type DescribeResponse struct {
+	Build              *VersionResponse  `json:"build"`
+	Methods            []string          `json:"methods"`
+	PermissionTags     map[string]string `json:"permission_tags"`
+	RequireCreateTag   bool              `json:"require_create_tag"`
+	ReadOnly           bool              `json:"read_only"`
+	HashTokens         bool              `json:"hash_tokens"`
+	TokenPrefix        string            `json:"token_prefix,omitempty"`
+	MetadataEncrypted  bool              `json:"metadata_encrypted"`
+	MetadataSchema     bool              `json:"metadata_schema"`
+	DefaultTTL         int               `json:"default_ttl"`
+	MaxTTL             int               `json:"max_ttl"`
+	MaxLifetime        int64             `json:"max_lifetime"`
+	ClampLifetime      bool              `json:"clamp_lifetime"`
+	DefaultDeadline    int64             `json:"default_deadline"`
+	IdleTimeout        int64             `json:"idle_timeout"`
+	TombstoneRetention int64             `json:"tombstone_retention"`
+	QueryTimeout       int64             `json:"query_timeout"`
+	MaxInfoIDs         int               `json:"max_info_ids"`
+	MaxTokensPerUser   int               `json:"max_tokens_per_user"`
+	OTPLength          int               `json:"otp_length"`
+	OTPCharset         string            `json:"otp_charset,omitempty"`
+	EventsTopic        string            `json:"events_topic,omitempty"`
+}
+
+// describeHandler returns the capabilities of this instance derived from its
+// configuration, so clients and tooling don't have to guess its behaviour.
+func describeHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+	resp := &DescribeResponse{
+		Build:              buildInfo(),
+		Methods:            methods,
+		PermissionTags:     permissionTags,
+		RequireCreateTag:   opts.RequireCreate,
+		ReadOnly:           opts.ReadOnly,
+		HashTokens:         opts.HashTokens,
+		TokenPrefix:        opts.TokenPrefix,
+		MetadataEncrypted:  metadataEncrypted(),
+		MetadataSchema:     metadataSchema != nil,
+		DefaultTTL:         defaultTTL,
+		MaxTTL:             opts.MaxTTL,
+		MaxLifetime:        int64(opts.MaxLifetime.Seconds()),
+		ClampLifetime:      opts.ClampLifetime,
+		DefaultDeadline:    int64(opts.DefaultDeadline.Seconds()),
+		IdleTimeout:        int64(opts.IdleTimeout.Seconds()),
+		TombstoneRetention: int64(opts.TombstoneRetention.Seconds()),
+		QueryTimeout:       int64(opts.QueryTimeout.Seconds()),
+		MaxInfoIDs:         opts.MaxInfoIDs,
+		MaxTokensPerUser:   opts.MaxTokensPerUser,
+		OTPLength:          opts.OTPLength,
+		EventsTopic:        opts.EventsTopic,
+	}
+	if opts.OTPLength > 0 {
+		resp.OTPCharset = opts.OTPCharset
+	}
+	return resp, nil
+}
+
+// WhoamiResponse holds the caller's effective tags over a path, and which of the
+// permissionTags actions they grant there.
+type WhoamiResponse struct {
+	User        string                 `json:"user"`
+	Path        string                 `json:"path"`
+	Tags        map[string]interface{} `json:"tags"`
+	Permissions map[string]bool        `json:"permissions"`
+}
+
+// whoamiHandler returns the caller and its effective tags over the path param, its
+// own path by default, to help tell why a call is or isn't permitted. Callers only
+// ever see their own tags.
+func whoamiHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+	path := task.User
+	if p, err := ei.N(task.Params).M("path").String(); err == nil {
+		path = p
+	}
+
+	res, err := task.GetConn().UserGetEffectiveTags(task.User, path)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+	tags := ei.N(res).M("tags").MapStrZ()
+
+	admin := ei.N(tags).M("@admin").BoolZ()
+	perms := make(map[string]bool, len(permissionTags))
+	for action, tag := range permissionTags {
+		perms[action] = admin || ei.N(tags).M(tag).BoolZ()
+	}
+	// list still accepts the deprecated tag.
+	perms["list"] = perms["list"] || ei.N(tags).M(legacyListTag).BoolZ()
+	return &WhoamiResponse{User: task.User, Path: path, Tags: tags, Permissions: perms}, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+// Error codes returned by the service methods besides the nxsugar ones. Clients
+// switch on these values, so they are stable: never renumber or reuse a code.
+const (
+	errInvalidToken        = 2  // Token unknown, exhausted or past its deadline
+	errStoreFailed         = 3  // The token couldn't be stored
+	errDeadlinePast        = 4  // Requested deadline is in the past
+	errDeadlineParse       = 5  // Requested deadline isn't a valid time
+	errTokenExpired        = 6  // Token exists but can no longer be used
+	errScopeMissing        = 7  // Token lacks the scope required for login
+	errMetadataMismatch    = 8  // Token metadata differs from the expected one
+	errUnknownUser         = 9  // User to impersonate is unknown to nexus
+	errTooManyAttempts     = 10 // Token blocked after repeated failed logins
+	errImpersonation       = 11 // Effective tags for impersonation couldn't be read
+	errLifetimeExceeded    = 12 // Requested deadline is beyond --max-lifetime
+	errReadOnly            = 13 // Method writes and the service runs with --read-only
+	errQueryTimeout        = 14 // Read queries took longer than --query-timeout
+	errFingerprintMismatch = 15 // Token is bound to another client fingerprint
+	errUnavailable         = 16 // RethinkDB is temporarily unavailable, retry later
+	errQuotaExceeded       = 17 // User would exceed --max-tokens-per-user
+)
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// TokenEvent is published to --events-topic.<user> whenever one of the user's tokens
+// is created, updated or deleted, or reaches its deadline, so UIs can follow token
+// status without polling. Clients don't subscribe to --events-topic themselves: the
+// service's nexus user must be the only one granted @topic.sub over it, and clients
+// call subscribe_events, which checks the same permissions as list before subscribing
+// their pipe on their behalf.
+type TokenEvent struct {
+	Event    string    `json:"event"`
+	Token    string    `json:"token"`
+	User     string    `json:"user"`
+	Live     bool      `json:"live"`
+	TTL      int       `json:"ttl"`
+	Deadline time.Time `json:"deadline"`
+	Status   string    `json:"status,omitempty"`
+}
+
+const eventsRetryDelay = 5 * time.Second
+
+// expiryCheckInterval is how often the events publisher looks for tokens that reached
+// their deadline.
+const expiryCheckInterval = 10 * time.Second
+
+// eventsLease is how long the elected events publisher keeps the lease without
+// renewing it, which it does every third of it.
+const eventsLease = 30 * time.Second
+
+// publishing is 1 while this instance is the elected events publisher.
+var publishing int32
+
+// electEventsPublisher takes or renews the events lease forever, so that only one
+// instance of the fleet publishes each change. If the lock can't be written the
+// instance publishes anyway: duplicate events are better than none. A handover may
+// still drop or repeat the changes made while it happens.
+func electEventsPublisher() {
+	for {
+		held, err := acquireLease(eventsLockID, eventsLease)
+		if err != nil {
+			srv.Log(nxsugar.WarnLevel, "Error taking the events lock, publishing unlocked: %v", err)
+			held = true
+		}
+		if held {
+			atomic.StoreInt32(&publishing, 1)
+		} else {
+			atomic.StoreInt32(&publishing, 0)
+		}
+		time.Sleep(eventsLease / 3)
+	}
+}
+
+// publishingEvents reports whether this instance is the elected events publisher.
+func publishingEvents() bool {
+	return atomic.LoadInt32(&publishing) == 1
+}
+
+// watchTokenEvents follows the changefeed of table forever while this instance is the
+// events publisher, restarting it when it breaks.
+func watchTokenEvents(table string) {
+	for {
+		if publishingEvents() {
+			if err := followTokenEvents(table); err != nil {
+				srv.Log(nxsugar.ErrorLevel, "Token events changefeed error on %s: %v", table, err)
+			}
+		}
+		time.Sleep(eventsRetryDelay)
+	}
+}
+
+func followTokenEvents(table string) error {
+	cur, err := r.Table(table).Changes().Run(db)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+
+	var change struct {
+		NewValue map[string]interface{} `gorethink:"new_val"`
+		OldValue map[string]interface{} `gorethink:"old_val"`
+	}
+	for cur.Next(&change) {
+		// Another instance took over, its own feed publishes the change.
+		if !publishingEvents() {
+			return nil
+		}
+		prev, next := change.OldValue, change.NewValue
+		switch {
+		case next == nil:
+			publishTokenEvent("deleted", prev)
+		case prev == nil:
+			publishTokenEvent("created", next)
+		case ei.N(prev).M("user").StringZ() != ei.N(next).M("user").StringZ():
+			// Transferred tokens leave the old owner's stream and enter the new one's.
+			publishTokenEvent("deleted", prev)
+			publishTokenEvent("created", next)
+		case !onlySeen(prev, next):
+			publishTokenEvent("updated", next)
+		}
+		change.NewValue, change.OldValue = nil, nil
+	}
+	return cur.Err()
+}
+
+// watchExpiredTokens publishes an expired event for every token of table whose
+// deadline passes, looking through the deadline index every expiryCheckInterval for
+// those reached since the previous check. Reaching the deadline isn't a write, so the
+// changefeed never sees it. Tokens that couldn't log in anyway, such as revoked ones
+// whose deadline was set to the time of revocation, aren't reported.
+func watchExpiredTokens(table string) {
+	since, err := dbNow()
+	for err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting the time from RethinkDB: %v", err)
+		time.Sleep(eventsRetryDelay)
+		since, err = dbNow()
+	}
+	for range time.Tick(expiryCheckInterval) {
+		now, err := dbNow()
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error getting the time from RethinkDB: %v", err)
+			continue
+		}
+		// Only the publisher reports expirations, the rest keep up so they don't
+		// report a backlog when taking over.
+		if publishingEvents() {
+			if err := publishExpiredTokens(table, since, now); err != nil {
+				srv.Log(nxsugar.ErrorLevel, "Error publishing expired tokens of %s: %v", table, err)
+				continue
+			}
+		}
+		since = now
+	}
+}
+
+// publishExpiredTokens publishes an expired event for the tokens of table whose
+// deadline is in [since, until) and that could log in until then.
+func publishExpiredTokens(table string, since, until time.Time) error {
+	cur, err := withoutTombstones(r.Table(table).Between(since, until, r.BetweenOpts{Index: "deadline"})).
+		Filter(r.Row.Field("ttl").Ne(0)).
+		Filter(usesLeft(r.Row)).
+		Run(db)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	var doc map[string]interface{}
+	for cur.Next(&doc) {
+		publishTokenEvent("expired", doc)
+		doc = nil
+	}
+	return cur.Err()
+}
+
+// subscribeEventsHandler subscribes the pipe param to the token events of the caller,
+// of the user param or of the users under the path param, which the caller needs
+// @admin or listTag over, and returns the topic. The subscription lasts until the pipe
+// is closed.
+func subscribeEventsHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	pipeID, err := ei.N(task.Params).M("pipe").String()
+	if err != nil || pipeID == "" {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "pipe must be a pipe id"}
+	}
+	user, path, authz, jerr := tokensOwner(task)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if authz == "" {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	pipe, err := task.GetConn().PipeOpen(pipeID)
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Invalid pipe"}
+	}
+	topic := opts.EventsTopic + "." + user + path
+	if _, err := task.GetConn().TopicSubscribe(pipe, topic); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error subscribing pipe to %s: %v", topic, err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+	srv.Log(nxsugar.InfoLevel, "%s subscribed to %s with %s", task.User, topic, authz)
+	return topic, nil
+}
+
+// onlySeen reports whether prev and next only differ in lastSeen, as after a login
+// served from the cache, which doesn't change the token's status.
+func onlySeen(prev, next map[string]interface{}) bool {
+	if len(prev) != len(next) {
+		return false
+	}
+	for k, v := range next {
+		if k != "lastSeen" && !reflect.DeepEqual(prev[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+func publishTokenEvent(event string, doc map[string]interface{}) {
+	status := tokenStatus(doc, time.Now())
+	ev := &TokenEvent{
+		Event:    event,
+		Token:    tokenRef(doc),
+		User:     ei.N(doc).M("user").StringZ(),
+		Live:     status.Live && event != "deleted",
+		TTL:      status.TTL,
+		Deadline: status.Deadline,
+		Status:   ei.N(doc).M("status").StringZ(),
+	}
+	if _, err := srv.GetConn().TopicPublish(opts.EventsTopic+"."+ev.User, ev); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error publishing token event: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// serveHealth exposes liveness and readiness probes on --health-addr. Liveness
+// only confirms the process is up, readiness also pings RethinkDB.
+func serveHealth() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if err := dbPing(); err != nil {
+			srv.Log(nxsugar.WarnLevel, "Readiness check failed: %v", err)
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	if err := http.ListenAndServe(opts.HealthAddr, mux); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error serving health checks: %v", err)
+	}
+}
+
+// dbPing runs a trivial query to check the RethinkDB session is usable.
+func dbPing() error {
+	cur, err := r.Expr(1).Run(db)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	var one int
+	return cur.One(&one)
+}
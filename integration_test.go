@@ -0,0 +1,172 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/jaracil/ei"
+)
+
+// These tests run the token queries against a real RethinkDB, the one in
+// RETHINKDB_HOST or else localhost:28015, in a scratch nexusTokenAuthTest database
+// whose tokens table they empty first:
+//
+//	go test -tags integration
+
+const testDatabase = "nexusTokenAuthTest"
+
+// testTable connects to the test database and returns its emptied tokens table.
+func testTable(t *testing.T) r.Term {
+	host := os.Getenv("RETHINKDB_HOST")
+	if host == "" {
+		host = "localhost:28015"
+	}
+	var err error
+	db, err = r.Connect(r.ConnectOpts{Address: host, Database: testDatabase, MaxOpen: 50})
+	if err != nil {
+		t.Fatalf("Error connecting to RethinkDB at %s: %v", host, err)
+	}
+	_, err = r.Branch(r.DBList().Contains(testDatabase), nil, r.DBCreate(testDatabase)).Run(db)
+	if err != nil {
+		t.Fatalf("Error creating the test database: %v", err)
+	}
+	if err := bootstrapTable(defaultTable); err != nil {
+		t.Fatalf("Error bootstrapping the tokens table: %v", err)
+	}
+	if _, err := r.Table(defaultTable).Delete().RunWrite(db); err != nil {
+		t.Fatalf("Error emptying the tokens table: %v", err)
+	}
+	return r.Table(defaultTable)
+}
+
+// insertTestToken stores a live token of user test under id with the given fields.
+func insertTestToken(t *testing.T, table r.Term, id string, fields ei.M) {
+	doc := ei.M{"id": id, "user": "test", "deadline": time.Now().Add(time.Hour)}
+	for k, v := range fields {
+		doc[k] = v
+	}
+	if _, err := table.Insert(doc).RunWrite(db); err != nil {
+		t.Fatalf("Error inserting token %s: %v", id, err)
+	}
+}
+
+// testTokenField returns field of the token stored under id.
+func testTokenField(t *testing.T, table r.Term, id, field string) interface{} {
+	cur, err := table.Get(id).Field(field).Run(db)
+	if err != nil {
+		t.Fatalf("Error getting %s of token %s: %v", field, id, err)
+	}
+	defer cur.Close()
+	var v interface{}
+	if err := cur.One(&v); err != nil {
+		t.Fatalf("Error getting %s of token %s: %v", field, id, err)
+	}
+	return v
+}
+
+// A token with a single use left, out of ttl or of max_uses, must log in exactly once
+// however many logins race for it, and only ever touch its own document.
+func TestConcurrentLoginsTakeTheLastUseOnce(t *testing.T) {
+	table := testTable(t)
+	cases := map[string]ei.M{
+		"ttl":      {"ttl": 1},
+		"max_uses": {"ttl": unlimitedTTL, "max_uses": 1, "use_count": 0},
+	}
+	for name, fields := range cases {
+		key := "concurrent-" + name
+		insertTestToken(t, table, key, fields)
+		// A token whose key extends this one must not be matched.
+		insertTestToken(t, table, key+"0", ei.M{"ttl": 1})
+
+		var wg sync.WaitGroup
+		var logins int32
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ret, err := loginUpdate(table, key, "", "").RunWrite(db)
+				if err != nil {
+					t.Errorf("%s: login error: %v", name, err)
+					return
+				}
+				if len(ret.Changes) > 1 {
+					t.Errorf("%s: login changed %d tokens", name, len(ret.Changes))
+				}
+				if len(ret.Changes) == 1 {
+					atomic.AddInt32(&logins, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if logins != 1 {
+			t.Errorf("%s: %d logins succeeded, want 1", name, logins)
+		}
+		if ttl := ei.N(testTokenField(t, table, key+"0", "ttl")).IntZ(); ttl != 1 {
+			t.Errorf("%s: neighbouring token has ttl %d, want 1", name, ttl)
+		}
+	}
+}
+
+// A login takes one use of exactly the token stored under its key and returns the
+// updated document: limited tokens lose one ttl, unlimited ones keep it, and tokens
+// with max_uses count the use. Tokens with no use left change nothing.
+func TestLoginDecrementsAndReturnsToken(t *testing.T) {
+	table := testTable(t)
+	cases := []struct {
+		name     string
+		fields   ei.M
+		ttl      int
+		useCount int
+		login    bool
+	}{
+		{name: "limited", fields: ei.M{"ttl": 3}, ttl: 2, login: true},
+		{name: "unlimited", fields: ei.M{"ttl": unlimitedTTL}, ttl: unlimitedTTL, login: true},
+		{name: "max_uses", fields: ei.M{"ttl": 5, "max_uses": 2, "use_count": 1}, ttl: 4, useCount: 2, login: true},
+		{name: "exhausted", fields: ei.M{"ttl": 0}},
+		{name: "used_up", fields: ei.M{"ttl": 5, "max_uses": 2, "use_count": 2}},
+		{name: "expired", fields: ei.M{"ttl": 3, "deadline": time.Now().Add(-time.Hour)}},
+	}
+	for _, c := range cases {
+		key := "login-" + c.name
+		insertTestToken(t, table, key, c.fields)
+		insertTestToken(t, table, key+"0", ei.M{"ttl": 3})
+
+		ret, err := loginUpdate(table, key, "", "").RunWrite(db)
+		if err != nil {
+			t.Fatalf("%s: login error: %v", c.name, err)
+		}
+		if !c.login {
+			if len(ret.Changes) != 0 {
+				t.Errorf("%s: login changed %d tokens, want none", c.name, len(ret.Changes))
+			}
+			continue
+		}
+		if len(ret.Changes) != 1 {
+			t.Fatalf("%s: login changed %d tokens, want 1", c.name, len(ret.Changes))
+		}
+		doc := ret.Changes[0].NewValue
+		if id := ei.N(doc).M("id").StringZ(); id != key {
+			t.Errorf("%s: login returned token %q, want %q", c.name, id, key)
+		}
+		if ttl := ei.N(doc).M("ttl").IntZ(); ttl != c.ttl {
+			t.Errorf("%s: ttl is %d after login, want %d", c.name, ttl, c.ttl)
+		}
+		if useCount := ei.N(doc).M("use_count").IntZ(); useCount != c.useCount {
+			t.Errorf("%s: use_count is %d after login, want %d", c.name, useCount, c.useCount)
+		}
+		if ei.N(doc).M("lastSeen").RawZ() == nil {
+			t.Errorf("%s: lastSeen not set on login", c.name)
+		}
+		if ttl := ei.N(testTokenField(t, table, key+"0", "ttl")).IntZ(); ttl != 3 {
+			t.Errorf("%s: neighbouring token has ttl %d, want 3", c.name, ttl)
+		}
+	}
+}
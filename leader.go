@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// With --cleanup-lock, instances elect which one runs the periodic cleanup through a
+// lease stored in a single row of cleanupLockTable. The holder renews the lease on each
+// of its sweeps; if it dies the lease runs out and the next instance to sweep takes over.
+// The publisher of token events is elected the same way through its own row.
+const (
+	cleanupLockTable = "cleanup_lock"
+	cleanupLockID    = "cleanup"
+	eventsLockID     = "events"
+)
+
+// instanceID identifies this process as the holder of a lease.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
+
+// bootstrapCleanupLock creates the lock table if missing. Failing to do so isn't
+// fatal: the leases fall back to running without the lock.
+func bootstrapCleanupLock() {
+	cur, err := r.TableList().Run(db)
+	if err != nil {
+		logf(nxsugar.WarnLevel, "Error listing tables, leases will run unlocked: %v", err)
+		return
+	}
+	tablelist := make([]string, 0)
+	err = cur.All(&tablelist)
+	cur.Close()
+	if err != nil {
+		logf(nxsugar.WarnLevel, "Error listing tables, leases will run unlocked: %v", err)
+		return
+	}
+	if inStrSlice(tablelist, cleanupLockTable) {
+		return
+	}
+	if opts.NoBootstrap {
+		logf(nxsugar.WarnLevel, "%s table is missing, leases will run unlocked", cleanupLockTable)
+		return
+	}
+	logf(nxsugar.InfoLevel, "Creating %s table", cleanupLockTable)
+	if _, err := r.TableCreate(cleanupLockTable).RunWrite(db); err != nil {
+		logf(nxsugar.WarnLevel, "Error creating %s table, leases will run unlocked: %v", cleanupLockTable, err)
+	}
+}
+
+// acquireCleanupLock takes or renews the cleanup lease and reports whether this
+// instance should sweep. The lease outlasts the longest jittered wait between sweeps
+// so the holder keeps it while alive. If the lock can't be written the instance
+// sweeps anyway: duplicate sweeps are wasteful but harmless.
+func acquireCleanupLock() bool {
+	lease := opts.CleanupInterval + time.Duration(opts.CleanupJitter*float64(opts.CleanupInterval))
+	held, err := acquireLease(cleanupLockID, lease)
+	if err != nil {
+		srv.Log(nxsugar.WarnLevel, "Error taking the cleanup lock, sweeping unlocked: %v", err)
+		return true
+	}
+	return held
+}
+
+// acquireLease takes or renews the lease stored in the id row of cleanupLockTable for
+// lease longer, and reports whether this instance holds it.
+func acquireLease(id string, lease time.Duration) (bool, error) {
+	ret, err := r.Table(cleanupLockTable).Insert(ei.M{
+		"id":      id,
+		"owner":   instanceID,
+		"expires": r.Now().Add(lease.Seconds()),
+	}, r.InsertOpts{Conflict: func(_, old, new r.Term) interface{} {
+		return r.Branch(old.Field("owner").Eq(instanceID).Or(old.Field("expires").Lt(r.Now())), new, old)
+	}}).RunWrite(db)
+	if err != nil {
+		return false, err
+	}
+	return ret.Inserted+ret.Replaced == 1, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// logf logs through srv.Log once the service exists. Before that (flag checks,
+// RethinkDB connection and bootstrap) it writes lines of the same shape itself,
+// as JSON when --production is set, so early lines don't break log parsing.
+func logf(level string, format string, args ...interface{}) {
+	if srv != nil {
+		srv.Log(level, format, args...)
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if opts.Production {
+		line, _ := json.Marshal(map[string]string{
+			"level": level,
+			"msg":   msg,
+			"time":  time.Now().Format(time.RFC3339),
+		})
+		fmt.Fprintln(os.Stderr, string(line))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s [%s] %s\n", time.Now().Format(time.RFC3339), level, msg)
+}
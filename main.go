@@ -1,8 +1,14 @@
 package main
 
 import (
-	"log"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
 	"time"
 
 	r "github.com/dancannon/gorethink"
@@ -12,17 +18,73 @@ import (
 )
 
 var opts struct {
-	Config     string `short:"c" default:"config.json" description:"nexus config file"`
-	Production bool   `long:"production" description:"Log as json"`
+	Config         string `short:"c" default:"config.json" description:"nexus config file"`
+	Production     bool   `long:"production" description:"Log as json"`
+	Version        bool   `long:"version" description:"Print the build version and exit"`
+	HashTokens     bool   `long:"hash-tokens" description:"Store only SHA-256 hashes of tokens in the database"`
+	TokenPrefix    string `long:"token-prefix" description:"Prefix of issued tokens, e.g. to tell environments apart (only affects new tokens)"`
+	MethodPrefix   string `long:"method-prefix" description:"Prefix of the registered method names, e.g. v2. to run two versions side by side"`
+	TokenIDs       string `long:"token-ids" description:"Scheme of the keys of new tokens; ulid keys sort by, and reveal, their creation time unless hashed" choice:"uuid" choice:"ulid" default:"uuid"`
+	RequireCreate  bool   `long:"require-create-tag" description:"Only allow callers with @sys.login.token.create to create tokens"`
+	AuditTopic     string `long:"audit-topic" description:"Nexus topic where token lifecycle events are published"`
+	EventsTopic    string `long:"events-topic" description:"Nexus topic prefix where token changes are pushed, per owner, by a single elected instance, for clients subscribed through subscribe_events (disabled if empty)"`
+	MaxTTL         int    `long:"max-ttl" description:"Maximum ttl a token can reach" default:"1000000"`
+	CacheUnlimited bool   `long:"cache-unlimited-tokens" description:"Serve logins of unlimited tokens from an in-memory cache"`
+	LogLogins      bool   `long:"log-logins" description:"Log every successful login"`
+	ReadOnly       bool   `long:"read-only" description:"Only serve methods that don't write to the database"`
+	NoBootstrap    bool   `long:"no-bootstrap" description:"Only verify the database, tables and indexes exist instead of creating them"`
+	MaxInfoIDs     int    `long:"max-info-ids" description:"Maximum number of ids per info or validate_batch call and of tokens per batch_create call" default:"1000"`
+	MetricsAddr    string `long:"metrics-addr" description:"Address to serve Prometheus metrics on (disabled if empty)"`
+	HealthAddr     string `long:"health-addr" description:"Address to serve health and readiness probes on (disabled if empty)"`
+
+	MaxTokensPerUser      int `long:"max-tokens-per-user" description:"Maximum live tokens a user can hold when creating more (0 disables)" default:"0"`
+	MaxTokensImpersonated int `long:"max-tokens-impersonated" description:"Maximum live tokens of a user when an admin creates them by impersonation (0 exempts them)" default:"0"`
+
+	Tenants []string `long:"tenant" description:"Tenant allowed to keep its tokens in its own table (repeatable)"`
+
+	MetadataKeys []string `long:"metadata-key" env:"TOKEN_METADATA_KEYS" env-delim:"," description:"Encrypt token metadata with this version:base64key; the first one encrypts, the rest only decrypt (repeatable)"`
+
+	CleanupInterval    time.Duration `long:"cleanup-interval" description:"Interval between expired token sweeps" default:"24h"`
+	CleanupJitter      float64       `long:"cleanup-jitter" description:"Randomly spread each sweep by up to this fraction of the cleanup interval" default:"0.1"`
+	CleanupDelay       time.Duration `long:"cleanup-initial-delay" description:"Delay before the first sweep (0 waits a full cleanup interval)" default:"0"`
+	CleanupLock        bool          `long:"cleanup-lock" description:"Elect a single instance to run the periodic cleanup"`
+	CleanupBatchSize   int           `long:"cleanup-batch-size" description:"Maximum number of tokens deleted per query by a cleanup" default:"10000"`
+	StatsInterval      time.Duration `long:"stats-interval" description:"Log token statistics at this interval, e.g. without Prometheus (0 disables)" default:"0"`
+	DefaultDeadline    time.Duration `long:"default-deadline" description:"Lifetime of tokens created without a deadline" default:"24h"`
+	MaxLifetime        time.Duration `long:"max-lifetime" description:"Maximum lifetime of the deadlines given to create, otp, renew and refresh (0 disables)" default:"0"`
+	ClampLifetime      bool          `long:"clamp-lifetime" description:"Clamp deadlines beyond --max-lifetime instead of rejecting them"`
+	RejectAnomalies    bool          `long:"reject-deadline-anomalies" description:"Reject logins of tokens whose deadline is beyond --max-lifetime from now instead of only logging them"`
+	QueryTimeout       time.Duration `long:"query-timeout" description:"Fail read method calls whose database queries take longer than this (0 disables)" default:"0"`
+	IdleTimeout        time.Duration `long:"idle-timeout" description:"Delete tokens not seen for this long (0 disables)" default:"0"`
+	TombstoneRetention time.Duration `long:"tombstone-retention" description:"Keep consumed and revoked tokens for this long before deleting them (0 disables)" default:"0"`
+
+	LoginMaxFailures   int           `long:"login-max-failures" description:"Failed logins per token before blocking it (0 disables)" default:"10"`
+	LoginFailureWindow time.Duration `long:"login-failure-window" description:"Window in which failed logins are counted" default:"1m"`
+	LoginCooldown      time.Duration `long:"login-cooldown" description:"How long a blocked token stays blocked" default:"5m"`
+
+	OTPTTL         int           `long:"otp-ttl" description:"Default ttl of OTP tokens" default:"1"`
+	OTPLifetime    time.Duration `long:"otp-lifetime" description:"Default lifetime of OTP tokens" default:"1h"`
+	OTPLength      int           `long:"otp-length" description:"Issue OTPs as short codes of this length instead of full tokens, without --token-prefix (0 disables)" default:"0"`
+	OTPCharset     string        `long:"otp-charset" description:"Characters of short OTP codes" choice:"numeric" choice:"alphanumeric" default:"numeric"`
+	OTPMaxFailures int           `long:"otp-max-failures" description:"Failed short OTP logins per tenant before blocking them (0 disables)" default:"100"`
 
 	Rethink RethinkOptions `group:"RethinkDB Options"`
 }
 
 type RethinkOptions struct {
-	Host     []string `short:"r" long:"rethinkdb" description:"RethinkDB host[:port]" default:"localhost:28015"`
-	Database string   `long:"db" description:"RethinkDB database" default:"nexusTokenAuth"`
-	User     string   `long:"ruser" description:"RethinkDB username" default:""`
-	Pass     string   `long:"rpass" description:"RethinkDB password" default:""`
+	Host     []string `short:"r" long:"rethinkdb" env:"RETHINKDB_HOST" env-delim:"," description:"RethinkDB host[:port]" default:"localhost:28015"`
+	Database string   `long:"db" env:"RETHINKDB_DATABASE" description:"RethinkDB database" default:"nexusTokenAuth"`
+	User     string   `long:"ruser" env:"RETHINKDB_USER" description:"RethinkDB username" default:""`
+	Pass     string   `long:"rpass" env:"RETHINKDB_PASS" description:"RethinkDB password" default:""`
+
+	Retries       int           `long:"rethink-retries" description:"RethinkDB connection attempts before giving up" default:"10"`
+	RetryMaxDelay time.Duration `long:"rethink-retry-max-delay" description:"Maximum delay between RethinkDB connection attempts" default:"30s"`
+
+	MaxIdle int `long:"rethink-max-idle" description:"Maximum idle RethinkDB connections in the pool" default:"50"`
+	MaxOpen int `long:"rethink-max-open" description:"Maximum open RethinkDB connections in the pool" default:"200"`
+
+	Discover            bool          `long:"rethink-discover" description:"Discover RethinkDB cluster nodes and follow membership changes"`
+	NodeRefreshInterval time.Duration `long:"rethink-node-refresh-interval" description:"Interval between cluster node discoveries (0 uses the driver default)" default:"0"`
 }
 
 var (
@@ -30,16 +92,40 @@ var (
 	srv *nxsugar.Service
 )
 
-func dbOpen() (err error) {
-	db, err = r.Connect(r.ConnectOpts{
-		Addresses: opts.Rethink.Host,
-		Database:  opts.Rethink.Database,
-		MaxIdle:   50,
-		MaxOpen:   200,
-		Username:  opts.Rethink.User,
-		Password:  opts.Rethink.Pass,
+// dbOpen connects to RethinkDB, retrying with exponential backoff up to
+// --rethink-retries attempts.
+func dbOpen() error {
+	return dbRetry("connecting to", func() (err error) {
+		db, err = r.Connect(r.ConnectOpts{
+			Addresses:           opts.Rethink.Host,
+			Database:            opts.Rethink.Database,
+			MaxIdle:             opts.Rethink.MaxIdle,
+			MaxOpen:             opts.Rethink.MaxOpen,
+			Username:            opts.Rethink.User,
+			Password:            opts.Rethink.Pass,
+			DiscoverHosts:       opts.Rethink.Discover,
+			NodeRefreshInterval: opts.Rethink.NodeRefreshInterval,
+		})
+		return err
 	})
-	return
+}
+
+// dbRetry runs connect until it succeeds or --rethink-retries attempts fail, doubling
+// the delay between attempts up to --rethink-retry-max-delay.
+func dbRetry(what string, connect func() error) (err error) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err = connect()
+		if err == nil || attempt >= opts.Rethink.Retries {
+			return
+		}
+		logf(nxsugar.WarnLevel, "Error %s RethinkDB (attempt %d/%d): %v. Retrying in %v", what, attempt, opts.Rethink.Retries, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > opts.Rethink.RetryMaxDelay {
+			delay = opts.Rethink.RetryMaxDelay
+		}
+	}
 }
 
 func dbBootstrap() error {
@@ -61,13 +147,52 @@ func dbBootstrap() error {
 		}
 	}
 	if !dbexists {
+		if opts.NoBootstrap {
+			return missingSchema("database " + opts.Rethink.Database)
+		}
 		_, err := r.DBCreate(opts.Rethink.Database).RunWrite(db)
 		if err != nil {
 			return err
 		}
 	}
 
-	cur, err = r.TableList().Run(db)
+	if opts.CleanupLock || opts.EventsTopic != "" {
+		bootstrapCleanupLock()
+	}
+
+	if err := ensureTable(defaultTable); err != nil {
+		return err
+	}
+	// Tenant tables are bootstrapped upfront too so that the cleanup, stats and events
+	// cover them right after a restart, not only once a request uses the tenant.
+	for _, tenant := range opts.Tenants {
+		if err := ensureTable(tenantTable(tenant)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenIndexes are the secondary indexes of token tables. Indexes without fn index
+// the field of the same name; multi indexes index each element of an array.
+var tokenIndexes = []struct {
+	name  string
+	fn    interface{}
+	multi bool
+}{
+	{name: "user"},
+	{name: "deadline"},
+	{name: "tags", multi: true},
+	{name: "parent"},
+	{name: "session_id", fn: func(row r.Term) interface{} {
+		return row.Field("metadata").Field("session_id")
+	}},
+}
+
+// bootstrapTable creates the named tokens table and its indexes if missing, or with
+// --no-bootstrap fails if any is.
+func bootstrapTable(name string) error {
+	cur, err := r.TableList().Run(db)
 	if err != nil {
 		return err
 	}
@@ -77,17 +202,57 @@ func dbBootstrap() error {
 	if err != nil {
 		return err
 	}
-	if !inStrSlice(tablelist, "tokens") {
-		log.Println("Creating tokens table")
-		_, err := r.TableCreate("tokens").RunWrite(db)
+	if !inStrSlice(tablelist, name) {
+		if opts.NoBootstrap {
+			return missingSchema("table " + name)
+		}
+		logf(nxsugar.InfoLevel, "Creating %s table", name)
+		_, err := r.TableCreate(name).RunWrite(db)
 		if err != nil {
 			return err
 		}
 	}
 
+	cur, err = r.Table(name).IndexList().Run(db)
+	if err != nil {
+		return err
+	}
+	indexlist := make([]string, 0)
+	err = cur.All(&indexlist)
+	cur.Close()
+	if err != nil {
+		return err
+	}
+	for _, index := range tokenIndexes {
+		if !inStrSlice(indexlist, index.name) {
+			if opts.NoBootstrap {
+				return missingSchema(fmt.Sprintf("index %s of table %s", index.name, name))
+			}
+			logf(nxsugar.InfoLevel, "Creating %s index", index.name)
+			indexOpts := r.IndexCreateOpts{Multi: index.multi}
+			stmt := r.Table(name).IndexCreate(index.name, indexOpts)
+			if index.fn != nil {
+				stmt = r.Table(name).IndexCreateFunc(index.name, index.fn, indexOpts)
+			}
+			_, err := stmt.RunWrite(db)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = r.Table(name).IndexWait().Run(db)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// missingSchema is returned with --no-bootstrap for a missing database, table or index.
+func missingSchema(what string) error {
+	return fmt.Errorf("RethinkDB %s is missing and --no-bootstrap is set, it must be provisioned beforehand", what)
+}
+
 func inStrSlice(slice []string, str string) bool {
 	for _, s := range slice {
 		if s == str {
@@ -97,261 +262,2807 @@ func inStrSlice(slice []string, str string) bool {
 	return false
 }
 
+const minCleanupInterval = time.Minute
+
+// Token ttl semantics: a positive ttl is the number of logins left and is
+// decremented on each login, 0 means exhausted (and is removed by the cleanup
+// sweep), and unlimitedTTL marks a token that can log in any number of times
+// until its deadline. Other negative values are rejected on create; any already
+// stored by older versions are treated as unlimited as well.
+const unlimitedTTL = -1
+
+// minOTPLength keeps short OTP codes from being trivially guessable.
+const minOTPLength = 4
+
+type handler func(*nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr)
+
+// readMethods are the methods that never write to the database, the only ones
+// served with --read-only. login writes too, as it consumes ttl.
+var readMethods = map[string]bool{
+	"list":             true,
+	"info":             true,
+	"count":            true,
+	"search":           true,
+	"stats":            true,
+	"ping":             true,
+	"find_by_session":  true,
+	"validate_batch":   true,
+	"expiring":         true,
+	"list_by_tag":      true,
+	"export":           true,
+	"describe":         true,
+	"users":            true,
+	"children":         true,
+	"whoami":           true,
+	"version":          true,
+	"count_by_status":  true,
+	"subscribe_events": true,
+}
+
+// addMethod registers h under name, prefixed with --method-prefix, instrumenting it
+// when metrics are enabled.
+func addMethod(name string, h handler) {
+	if opts.ReadOnly && !readMethods[name] {
+		h = func(*nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+			return nil, &nxsugar.JsonRpcErr{Cod: errReadOnly, Mess: "Service in read-only mode"}
+		}
+	}
+	h = withReconnect(name, h)
+	h = withTimeout(name, h)
+	h = withTenant(h)
+	if opts.MetricsAddr != "" {
+		h = instrument(name, h)
+	}
+	srv.AddMethod(opts.MethodPrefix+name, h)
+	methods = append(methods, opts.MethodPrefix+name)
+}
+
 func main() {
-	_, err := flags.Parse(&opts)
+	parser := flags.NewParser(&opts, flags.Default)
+	_, err := parser.Parse()
 	if err != nil {
 		os.Exit(1)
 	}
+	if opts.Version {
+		fmt.Printf("nexus-auth-token %s (commit %s, built %s)\n", version, commit, buildDate)
+		os.Exit(0)
+	}
+	if err := loadTokenAuthConfig(parser); err != nil {
+		logf(nxsugar.ErrorLevel, "Error reading the tokenauth section of %s: %v", opts.Config, err)
+		os.Exit(1)
+	}
+	if defaultTTL == 0 || defaultTTL < unlimitedTTL || defaultTTL > opts.MaxTTL {
+		logf(nxsugar.ErrorLevel, "Default ttl must be %d or between 1 and max ttl", unlimitedTTL)
+		os.Exit(1)
+	}
+	if opts.CleanupInterval < minCleanupInterval {
+		logf(nxsugar.ErrorLevel, "Cleanup interval must be at least %v", minCleanupInterval)
+		os.Exit(1)
+	}
+	if opts.CleanupJitter < 0 || opts.CleanupJitter >= 1 {
+		logf(nxsugar.ErrorLevel, "Cleanup jitter must be at least 0 and less than 1")
+		os.Exit(1)
+	}
+	if opts.TokenIDs == "ulid" && opts.HashTokens {
+		logf(nxsugar.WarnLevel, "Token keys are hashed, ulid keys won't sort by creation time")
+	}
+	if opts.OTPLength > 0 && opts.HashTokens {
+		logf(nxsugar.WarnLevel, "Short OTP codes are hashed without salt, their hashes are trivially reversed")
+	}
+	if opts.OTPLength > 0 && opts.OTPMaxFailures <= 0 {
+		logf(nxsugar.WarnLevel, "Short OTP codes can be guessed without --otp-max-failures")
+	}
+	if opts.RejectAnomalies && opts.MaxLifetime <= 0 {
+		logf(nxsugar.WarnLevel, "Deadline anomalies are only detected with --max-lifetime")
+	}
+	if opts.CleanupBatchSize < 1 {
+		logf(nxsugar.ErrorLevel, "Cleanup batch size must be positive")
+		os.Exit(1)
+	}
+	if opts.StatsInterval < 0 {
+		logf(nxsugar.ErrorLevel, "Stats interval must not be negative")
+		os.Exit(1)
+	}
+	if opts.QueryTimeout < 0 {
+		logf(nxsugar.ErrorLevel, "Query timeout must not be negative")
+		os.Exit(1)
+	}
+	if opts.CleanupDelay < 0 {
+		logf(nxsugar.ErrorLevel, "Cleanup initial delay must not be negative")
+		os.Exit(1)
+	}
+	for _, tenant := range opts.Tenants {
+		if !tenantNameRe.MatchString(tenant) {
+			logf(nxsugar.ErrorLevel, "Invalid tenant name: %s", tenant)
+			os.Exit(1)
+		}
+	}
+	if opts.MaxTTL < 1 {
+		logf(nxsugar.ErrorLevel, "Max ttl must be positive")
+		os.Exit(1)
+	}
+	if err := loadMetadataKeys(opts.MetadataKeys); err != nil {
+		logf(nxsugar.ErrorLevel, "Invalid metadata key: %v", err)
+		os.Exit(1)
+	}
+	if opts.Rethink.MaxOpen < 1 || opts.Rethink.MaxIdle < 0 || opts.Rethink.MaxIdle > opts.Rethink.MaxOpen {
+		logf(nxsugar.ErrorLevel, "RethinkDB max open connections must be positive and max idle between 0 and max open")
+		os.Exit(1)
+	}
+	if opts.MaxInfoIDs < 1 {
+		logf(nxsugar.ErrorLevel, "Max info ids must be positive")
+		os.Exit(1)
+	}
+	if opts.IdleTimeout < 0 {
+		logf(nxsugar.ErrorLevel, "Idle timeout must not be negative")
+		os.Exit(1)
+	}
+	if opts.TombstoneRetention < 0 {
+		logf(nxsugar.ErrorLevel, "Tombstone retention must not be negative")
+		os.Exit(1)
+	}
+	if (opts.LoginMaxFailures > 0 || opts.OTPMaxFailures > 0) && (opts.LoginFailureWindow <= 0 || opts.LoginCooldown <= 0) {
+		logf(nxsugar.ErrorLevel, "Login failure window and cooldown must be positive")
+		os.Exit(1)
+	}
+	if opts.OTPTTL == 0 || opts.OTPTTL < unlimitedTTL || opts.OTPTTL > opts.MaxTTL {
+		logf(nxsugar.ErrorLevel, "OTP ttl must be %d or between 1 and max ttl", unlimitedTTL)
+		os.Exit(1)
+	}
+	if opts.OTPLength < 0 || (opts.OTPLength > 0 && opts.OTPLength < minOTPLength) {
+		logf(nxsugar.ErrorLevel, "OTP length must be 0 or at least %d", minOTPLength)
+		os.Exit(1)
+	}
+	if opts.OTPLifetime <= 0 {
+		logf(nxsugar.ErrorLevel, "OTP lifetime must be positive")
+		os.Exit(1)
+	}
+	if opts.DefaultDeadline <= 0 {
+		logf(nxsugar.ErrorLevel, "Default deadline must be positive")
+		os.Exit(1)
+	}
+	if opts.MaxLifetime < 0 || (opts.MaxLifetime > 0 && (opts.DefaultDeadline > opts.MaxLifetime || opts.OTPLifetime > opts.MaxLifetime)) {
+		logf(nxsugar.ErrorLevel, "Max lifetime must be 0 or at least the default deadline and OTP lifetime")
+		os.Exit(1)
+	}
 
 	err = dbOpen()
 	if err != nil {
-		log.Println(err)
+		logf(nxsugar.ErrorLevel, "%v", err)
 		return
 	}
 	err = dbBootstrap()
 	if err != nil {
-		log.Println(err)
+		logf(nxsugar.ErrorLevel, "%v", err)
 		return
 	}
-	log.Println("DB Opened")
+	logf(nxsugar.InfoLevel, "DB Opened")
 
 	nxsugar.SetFlagsEnabled(false)
 	nxsugar.SetConfigFile(opts.Config)
 	nxsugar.SetProductionMode(opts.Production)
 	srv, err = nxsugar.NewServiceFromConfig("token-auth")
 	if err != nil {
-		log.Fatalln(err)
+		logf(nxsugar.ErrorLevel, "%v", err)
+		os.Exit(1)
+	}
+	addMethod("login", loginHandler)
+	addMethod("otp", otpHandler)
+	addMethod("create", createHandler)
+	addMethod("consume", consumeHandler)
+	addMethod("list", listHandler)
+	addMethod("info", infoHandler)
+	addMethod("clear", clearHandler)
+	addMethod("revoke", revokeHandler)
+	addMethod("renew", renewHandler)
+	addMethod("add_uses", addUsesHandler)
+	addMethod("count", countHandler)
+	addMethod("search", searchHandler)
+	addMethod("touch", touchHandler)
+	addMethod("batch_create", batchCreateHandler)
+	addMethod("update_metadata", updateMetadataHandler)
+	addMethod("refresh", refreshHandler)
+	addMethod("bulk_revoke", bulkRevokeHandler)
+	addMethod("stats", statsHandler)
+	addMethod("ping", pingHandler)
+	addMethod("transfer", transferHandler)
+	addMethod("rotate_secret", rotateSecretHandler)
+	addMethod("purge_user", purgeUserHandler)
+	addMethod("find_by_session", findBySessionHandler)
+	addMethod("validate_batch", validateBatchHandler)
+	addMethod("expiring", expiringHandler)
+	addMethod("list_by_tag", listByTagHandler)
+	addMethod("export", exportHandler)
+	addMethod("import", importHandler)
+	addMethod("describe", describeHandler)
+	addMethod("users", usersHandler)
+	addMethod("children", childrenHandler)
+	addMethod("whoami", whoamiHandler)
+	addMethod("expire_by_metadata", expireByMetadataHandler)
+	addMethod("version", versionHandler)
+	addMethod("bulk_extend", bulkExtendHandler)
+	addMethod("count_by_status", countByStatusHandler)
+	if opts.EventsTopic != "" {
+		addMethod("subscribe_events", subscribeEventsHandler)
+	}
+
+	if opts.LoginMaxFailures > 0 {
+		limiter = newLoginLimiter(opts.LoginMaxFailures)
+	}
+	if opts.OTPLength > 0 && opts.OTPMaxFailures > 0 {
+		otpLimiter = newLoginLimiter(opts.OTPMaxFailures)
+	}
+
+	if opts.MetricsAddr != "" {
+		go serveMetrics()
+	}
+	if opts.HealthAddr != "" {
+		go serveHealth()
+	}
+
+	if opts.EventsTopic != "" {
+		go electEventsPublisher()
+		for _, table := range tokenTables() {
+			go watchTokenEvents(table)
+			go watchExpiredTokens(table)
+		}
+	}
+
+	if opts.CacheUnlimited && !opts.ReadOnly {
+		cache = newTokenCache()
+		go cache.run()
+	}
+
+	stop := make(chan struct{})
+	if !opts.ReadOnly {
+		go deleteExpiredTokensPeriodically(stop)
+	}
+	if opts.StatsInterval > 0 {
+		go logStatsPeriodically(stop)
 	}
-	srv.AddMethod("login", loginHandler)
-	srv.AddMethod("otp", otpHandler)
-	srv.AddMethod("create", createHandler)
-	srv.AddMethod("consume", consumeHandler)
-	srv.AddMethod("list", listHandler)
-	srv.AddMethod("info", infoHandler)
-	srv.AddMethod("clear", clearHandler)
 
-	go deleteExpiredTokensDaily()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		srv.Log(nxsugar.InfoLevel, "Received %v, shutting down", sig)
+		srv.GracefulStop()
+	}()
 
 	err = srv.Serve()
 	if err != nil {
-		log.Println("Lost connection with nexus:", err)
+		srv.Log(nxsugar.ErrorLevel, "Lost connection with nexus: %v", err)
+	}
+
+	close(stop)
+	if err := db.Close(); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error closing RethinkDB session: %v", err)
 	}
 }
 
+// LoginResponse is returned by login. Tags holds the effective tags of the user,
+// TokenTags the tags the token was created with.
 type LoginResponse struct {
-	User string `json:"user"`
-	Tags map[string]map[string]interface{}
+	User      string                            `json:"user"`
+	Tags      map[string]map[string]interface{} `json:"user_tags"`
+	Scopes    []string                          `json:"scopes,omitempty"`
+	TTL       int                               `json:"ttl"`
+	Deadline  time.Time                         `json:"deadline"`
+	ExpiresIn int64                             `json:"expires_in"`
+	UseCount  int                               `json:"use_count,omitempty"`
+	MaxUses   int                               `json:"max_uses,omitempty"`
+	Metadata  interface{}                       `json:"metadata"`
+	TokenTags []string                          `json:"tags,omitempty"`
 }
 
+// maxTokenLength bounds the token param of login, well above any issued token.
+const maxTokenLength = 256
+
 func loginHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
 
-	token := ei.N(task.Params).M("token").StringZ()
+	// Malformed tokens are rejected before they reach the limiter or RethinkDB.
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil || token == "" || len(token) > maxTokenLength {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("token must be a non-empty string of at most %d bytes", maxTokenLength)}
+	}
+	key := tokenKey(token)
+	scope := ei.N(task.Params).M("required_scope").StringZ()
+	fingerprint := ei.N(task.Params).M("fingerprint").StringZ()
 
-	ret, err := r.Table("tokens").
-		Between(token, token+"\uffff").
-		Filter(r.Row.Field("ttl").Ne(0)).
-		Filter(r.Row.Field("deadline").During(r.Now(), r.Row.Field("deadline"), r.DuringOpts{RightBound: "closed"})).
-		Update(r.Branch(r.Row.Field("ttl").Gt(0),
-			ei.M{"ttl": r.Row.Field("ttl").Add(-1), "lastSeen": r.Now()},
-			ei.M{"ttl": r.Row.Field("ttl"), "lastSeen": r.Now()}),
-			r.UpdateOpts{ReturnChanges: true}).
-		RunWrite(db)
+	if loginBlocked(task, key, token) {
+		return nil, &nxsugar.JsonRpcErr{Cod: errTooManyAttempts, Mess: "Too many attempts"}
+	}
+
+	if cache != nil && tableName(task) == defaultTable {
+		if doc, ok := cache.login(key); ok && tokenMatches(doc, token) {
+			if scope != "" && !scopeAllowed(doc, scope) {
+				return nil, &nxsugar.JsonRpcErr{Cod: errScopeMissing, Mess: "Token lacks required scope"}
+			}
+			if !fingerprintMatches(doc, fingerprint) {
+				loginFailed(task, key, token)
+				return nil, &nxsugar.JsonRpcErr{Cod: errFingerprintMismatch, Mess: "Fingerprint mismatch"}
+			}
+			if deadlineAnomaly(doc, time.Now()) && opts.RejectAnomalies {
+				return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+			}
+			if limiter != nil {
+				limiter.reset(key)
+			}
+			audit(task, "login", ei.N(doc).M("user").StringZ(), tokenRef(doc))
+			logLogin(doc)
+			return newLoginResponse(task, doc)
+		}
+	}
+
+	ret, err := loginUpdate(tokensTable(task), key, scope, fingerprint).RunWrite(db)
 	if err != nil {
-		log.Println("Error:", err)
-		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		return nil, dbError(err)
 	}
 
-	if len(ret.Changes) != 1 {
-		return nil, &nxsugar.JsonRpcErr{Cod: 2, Mess: "Invalid token"}
+	if len(ret.Changes) != 1 || !tokenMatches(ret.Changes[0].NewValue, token) {
+		jerr := &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+		if doc, err := getToken(task, key); err == nil && tokenMatches(doc, token) {
+			if scope != "" && !scopeAllowed(doc, scope) {
+				return nil, &nxsugar.JsonRpcErr{Cod: errScopeMissing, Mess: "Token lacks required scope"}
+			}
+			// Only tokens that could log in otherwise report the mismatch.
+			live := ei.N(doc).M("ttl").IntZ() != 0 && ei.N(doc).M("deadline").TimeZ().After(time.Now())
+			if live && !fingerprintMatches(doc, fingerprint) {
+				jerr = &nxsugar.JsonRpcErr{Cod: errFingerprintMismatch, Mess: "Fingerprint mismatch"}
+			}
+			if opts.RejectAnomalies {
+				deadlineAnomaly(doc, time.Now())
+			}
+		}
+		loginFailed(task, key, token)
+		return nil, jerr
 	}
 
-	return ret.Changes[0].NewValue, nil
+	if limiter != nil {
+		limiter.reset(key)
+	}
+	doc := ret.Changes[0].NewValue
+	deadlineAnomaly(doc, ei.N(doc).M("lastSeen").TimeZ())
+	audit(task, "login", ei.N(doc).M("user").StringZ(), tokenRef(doc))
+	logLogin(doc)
+	return newLoginResponse(task, doc)
 }
 
-func otpHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
-	log.Println("Creating OTP for", task.User)
+// loginUpdate builds the write of a login with the token stored under key in table:
+// it takes one use of the token if it can log in for scope from fingerprint, and
+// returns the updated document as its only change. Otherwise it changes nothing.
+func loginUpdate(table r.Term, key, scope, fingerprint string) r.Term {
 
-	ret, err := r.Table("tokens").Insert(ei.M{"user": task.User, "ttl": 1, "deadline": r.Now().Add(3600)}).
-		RunWrite(db)
-	if err == nil && len(ret.GeneratedKeys) > 0 {
-		return ret.GeneratedKeys[0], nil
+	// Tokens are looked up by their exact primary key, so a login can only ever
+	// match and decrement a single document.
+	stmt := table.
+		GetAll(key).
+		Filter(r.Row.Field("ttl").Ne(0)).
+		Filter(r.Row.Field("deadline").During(r.Now(), r.Row.Field("deadline"), r.DuringOpts{RightBound: "closed"}))
+	if scope != "" {
+		stmt = stmt.Filter(r.Row.Field("scopes").Default(nil).Eq(nil).Or(r.Row.Field("scopes").Contains(scope)))
 	}
+	stmt = stmt.Filter(r.Row.Field("bound_fingerprint").Default(nil).Eq(nil).Or(r.Row.Field("bound_fingerprint").Eq(fingerprint)))
+	if opts.RejectAnomalies && opts.MaxLifetime > 0 {
+		stmt = stmt.Filter(r.Row.Field("deadline").Le(r.Now().Add(opts.MaxLifetime.Seconds())))
+	}
+
+	// Tokens created with max_uses also count their logins in use_count and stop
+	// working once it reaches max_uses.
+	stmt = stmt.Filter(usesLeft(r.Row))
 
-	return nil, &nxsugar.JsonRpcErr{Cod: 3, Mess: err.Error()}
+	// The filters run before the update, so two concurrent logins could both see the
+	// last use left. The update checks again because RethinkDB applies it atomically
+	// per document: the losing login leaves the token untouched, gets no change back
+	// and fails.
+	usable := r.Row.Field("ttl").Ne(0).And(r.Row.Field("deadline").Ge(r.Now())).And(usesLeft(r.Row))
+	return stmt.
+		Update(r.Branch(usable,
+			r.Branch(r.Row.Field("ttl").Gt(0),
+				ei.M{"ttl": r.Row.Field("ttl").Add(-1), "lastSeen": r.Now()},
+				ei.M{"lastSeen": r.Now()}).
+				Merge(r.Branch(r.Row.HasFields("max_uses"), ei.M{"use_count": r.Row.Field("use_count").Add(1)}, ei.M{})),
+			ei.M{}),
+			r.UpdateOpts{ReturnChanges: true})
 }
 
-func createHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+// Failed logins are tracked per token: the task doesn't carry the client address and
+// the calling user may be shared by every client logging in through nexus. Short OTP
+// codes are few enough to enumerate, with a different code, and so a different token,
+// on every guess, so failures with them are also capped per tenant by
+// --otp-max-failures. Once the cap is reached, short OTP logins in the tenant are
+// blocked for everyone until the cooldown ends.
 
-	ttl := ei.N(task.Params).M("ttl").IntZ()
-	if ttl == 0 {
-		ttl = 1
+// loginBlocked reports whether logins with token, stored under key, are blocked.
+func loginBlocked(task *nxsugar.Task, key, token string) bool {
+	if limiter != nil && !limiter.allowed(key) {
+		return true
 	}
+	return otpLimiter != nil && shortOTP(token) && !otpLimiter.allowed(tableName(task))
+}
 
-	deadline, err := ei.N(task.Params).M("deadline").Time()
-	if err != nil {
-		return nil, &nxsugar.JsonRpcErr{Cod: 5, Mess: "Deadline conversion error"}
+// loginFailed records a failed login with token, stored under key.
+func loginFailed(task *nxsugar.Task, key, token string) {
+	if limiter != nil {
+		limiter.fail(key)
+	}
+	if otpLimiter != nil && shortOTP(token) {
+		otpLimiter.fail(tableName(task))
 	}
+}
 
-	cur, err := r.Expr(r.Now()).Run(db)
-	if err != nil {
-		log.Println("Error:", err)
-		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+// shortOTP reports whether token has the shape of a short OTP code.
+func shortOTP(token string) bool {
+	return opts.OTPLength > 0 && len(token) == opts.OTPLength
+}
+
+// deadlineAnomaly reports, and logs as possible tampering, whether doc's deadline is
+// further than --max-lifetime from now. Every method that stores a deadline limits it
+// to --max-lifetime from when it is stored, import included, so only tokens stored
+// before --max-lifetime was set or lowered are flagged besides tampered ones. Without
+// --max-lifetime nothing is anomalous.
+func deadlineAnomaly(doc interface{}, now time.Time) bool {
+	if opts.MaxLifetime <= 0 {
+		return false
 	}
-	var t time.Time
-	cur.One(&t)
-	if deadline.Before(t) {
-		return nil, &nxsugar.JsonRpcErr{Cod: 4, Mess: "Deadline is in the past"}
+	deadline := ei.N(doc).M("deadline").TimeZ()
+	if !deadline.After(now.Add(opts.MaxLifetime)) {
+		return false
 	}
+	srv.Log(nxsugar.WarnLevel, "Token %s of %s has its deadline %v beyond --max-lifetime, possible tampering",
+		tokenRef(doc), ei.N(doc).M("user").StringZ(), deadline)
+	return true
+}
 
-	user := task.User
-	userToImpersonate := ei.N(task.Params).M("user_to_impersonate").StringZ()
+// fingerprintMatches reports whether fingerprint is the one doc was bound to on
+// creation. Tokens created without bound_fingerprint match any.
+func fingerprintMatches(doc interface{}, fingerprint string) bool {
+	bound := ei.N(doc).M("bound_fingerprint").StringZ()
+	return bound == "" || subtle.ConstantTimeCompare([]byte(bound), []byte(fingerprint)) == 1
+}
 
-	if userToImpersonate != "" {
-		response, err := task.GetConn().UserGetEffectiveTags(user, userToImpersonate)
-		if err != nil {
-			return nil, &nxsugar.JsonRpcErr{Cod: 3, Mess: err.Error()}
-		}
-		isAdmin, err := ei.N(response).M("tags").M("@admin").Bool()
-		if err != nil {
-			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
-		}
-		if isAdmin == true {
-			user = userToImpersonate
-		} else {
-			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
-		}
+// logLogin logs a successful login when --log-logins is set. Only the hashed
+// token reference is logged, never the token itself.
+func logLogin(doc interface{}) {
+	if opts.LogLogins {
+		srv.Log(nxsugar.InfoLevel, "Login of %s with token %s", ei.N(doc).M("user").StringZ(), tokenRef(doc))
 	}
+}
 
-	metadata := ei.N(task.Params).M("metadata").RawZ()
-	ret, err := r.Table("tokens").Insert(ei.M{"user": user, "ttl": ttl, "deadline": deadline, "metadata": metadata}).RunWrite(db)
-	if err == nil && len(ret.GeneratedKeys) > 0 {
-		log.Println("Creating token for", user)
-
-		return ret.GeneratedKeys[0], nil
+// newLoginResponse builds the response to a successful login from the token document.
+// expires_in is measured against the lastSeen time set by the server on login so
+// clients don't depend on their own clock.
+func newLoginResponse(task *nxsugar.Task, doc interface{}) (*LoginResponse, *nxsugar.JsonRpcErr) {
+	if jerr := decryptTokens([]interface{}{doc}); jerr != nil {
+		return nil, jerr
+	}
+	deadline := ei.N(doc).M("deadline").TimeZ()
+	resp := &LoginResponse{
+		User:      ei.N(doc).M("user").StringZ(),
+		Tags:      userTags(task, ei.N(doc).M("user").StringZ()),
+		TTL:       ei.N(doc).M("ttl").IntZ(),
+		Deadline:  deadline,
+		ExpiresIn: int64(deadline.Sub(ei.N(doc).M("lastSeen").TimeZ()).Seconds()),
+		UseCount:  ei.N(doc).M("use_count").IntZ(),
+		MaxUses:   ei.N(doc).M("max_uses").IntZ(),
+		Metadata:  ei.N(doc).M("metadata").RawZ(),
 	}
+	resp.Scopes, _ = stringSlice(ei.N(doc).M("scopes").RawZ())
+	resp.TokenTags, _ = stringSlice(ei.N(doc).M("tags").RawZ())
+	return resp, nil
+}
 
-	return nil, &nxsugar.JsonRpcErr{Cod: 3, Mess: err.Error()}
+// userTags returns the effective tags of user over the tag_prefix param, or over the
+// root path, keyed by that path. The token has already been used by then, so if the
+// tags can't be read the login still succeeds without them rather than wasting the use.
+func userTags(task *nxsugar.Task, user string) map[string]map[string]interface{} {
+	prefix := ei.N(task.Params).M("tag_prefix").StringZ()
+	res, err := task.GetConn().UserGetEffectiveTags(user, prefix)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil
+	}
+	tags, err := ei.N(res).M("tags").MapStr()
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error parsing tags: %v", err)
+		return nil
+	}
+	return map[string]map[string]interface{}{prefix: tags}
 }
 
-func consumeHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+// touchHandler marks a live token as seen without consuming any of its ttl.
+func touchHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
 
 	token, err := ei.N(task.Params).M("token").String()
 	if err != nil {
-		return nil, &nxsugar.JsonRpcErr{Cod: 2, Mess: "Invalid token"}
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
 	}
 
-	ret, err := r.Table("tokens").Get(token).
-		Delete(r.DeleteOpts{ReturnChanges: true}).RunWrite(db)
+	ret, err := activeTokens(tokensTable(task).GetAll(tokenKey(token))).
+		Update(ei.M{"lastSeen": r.Now()}, r.UpdateOpts{ReturnChanges: "always"}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
 
-	if len(ret.Changes) != 1 {
-		return nil, &nxsugar.JsonRpcErr{Cod: 2, Mess: "Invalid token"}
+	if len(ret.Changes) != 1 || !tokenMatches(ret.Changes[0].NewValue, token) {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
 	}
 
-	return ret.Changes[0].NewValue, nil
+	return decryptedToken(ret.Changes[0].NewValue)
 }
 
-func listHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
-
-	user := task.User
-	stmt := r.Table("tokens")
+type PingResponse struct {
+	Live      bool      `json:"live"`
+	TTL       int       `json:"ttl"`
+	Deadline  time.Time `json:"deadline"`
+	ExpiresIn int64     `json:"expires_in"`
+}
 
-	if path := ei.N(task.Params).M("path").StringZ(); path != "" {
-		tags, err := task.GetConn().UserGetEffectiveTags(user, path)
-		if err != nil {
-			log.Println("Error: ", err)
-			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
-		}
+// pingHandler reports whether a token could log in right now without writing anything.
+func pingHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
 
-		if ei.N(tags).M("tags").M("@admin").BoolZ() || ei.N(tags).M("tags").M("@sys.login.token.list").BoolZ() {
-			stmt = stmt.Filter(r.Row.Field("user").Match("^" + path + "($|.)"))
-		} else {
-			return nil, nil
-		}
-	} else {
-		stmt = stmt.Filter(r.Row.Field("user").Eq(user))
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
 	}
 
-	res, err := stmt.Run(db)
-	if err != nil {
-		log.Println("Error: ", err)
-		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	doc, jerr := getToken(task, tokenKey(token))
+	if jerr != nil {
+		return nil, jerr
 	}
-	defer res.Close()
-	var tokens []interface{}
-	if err := res.All(&tokens); err != nil {
-		log.Println("Error getting query results: ", err)
-		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	if !tokenMatches(doc, token) {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
 	}
 
-	return tokens, nil
+	t, err := dbNow()
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return tokenStatus(doc, t), nil
 }
 
-func infoHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
-	ids := ei.N(task.Params).M("ids").SliceZ()
+// validateBatchHandler reports, like ping, whether each of the tokens param could log
+// in right now, in the same order. The tokens are read with a single query and nothing
+// is written.
+func validateBatchHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
 
-	res, err := r.Table("tokens").
-		GetAll(ids...).Run(db)
+	tokens, err := stringSlice(ei.N(task.Params).M("tokens").RawZ())
+	if err != nil || len(tokens) == 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "tokens must be a non-empty array of strings"}
+	}
+	if len(tokens) > opts.MaxInfoIDs {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("At most %d tokens are allowed", opts.MaxInfoIDs)}
+	}
+
+	keys := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		keys[i] = tokenKey(token)
+	}
+	res, err := tokensTable(task).GetAll(keys...).Run(db)
 	if err != nil {
-		log.Println("Error: ", err)
-		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		return nil, dbError(err)
 	}
 	defer res.Close()
-
-	var tokensInfo []interface{}
-	if err := res.All(&tokensInfo); err != nil {
-		log.Println("Error getting query results: ", err)
+	var docs []map[string]interface{}
+	if err := res.All(&docs); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
 		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
 	}
+	byKey := make(map[string]map[string]interface{}, len(docs))
+	for _, doc := range docs {
+		byKey[ei.N(doc).M("id").StringZ()] = doc
+	}
 
-	user := task.User
-
-	for _, token := range tokensInfo {
-		path := ei.N(token).M("user").StringZ()
-		if path != user {
-			tags, err := task.GetConn().UserGetEffectiveTags(user, path)
-			if err != nil {
-				log.Println("Error getting effective tags: ", err)
-				return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams}
-			}
-			if !ei.N(tags).M("tags").M("@admin").BoolZ() && !ei.N(tags).M("tags").M("@token.list").BoolZ() {
-				log.Println("Error parsing tags: ", err)
-				return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams}
-			}
+	t, err := dbNow()
+	if err != nil {
+		return nil, dbError(err)
+	}
+	statuses := make([]*PingResponse, len(tokens))
+	for i, token := range tokens {
+		doc, ok := byKey[tokenKey(token)]
+		if !ok || !tokenMatches(doc, token) {
+			statuses[i] = &PingResponse{}
+			continue
 		}
+		statuses[i] = tokenStatus(doc, t)
 	}
-
-	return tokensInfo, nil
+	return statuses, nil
 }
 
-func clearHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
-	return deleteExpiredTokens()
+// tokenStatus evaluates whether doc can log in at time t.
+func tokenStatus(doc interface{}, t time.Time) *PingResponse {
+	ttl := ei.N(doc).M("ttl").IntZ()
+	deadline := ei.N(doc).M("deadline").TimeZ()
+	live := ttl != 0 && !deadline.Before(t)
+	if maxUses, err := ei.N(doc).M("max_uses").Int(); err == nil {
+		live = live && ei.N(doc).M("use_count").IntZ() < maxUses
+	}
+	return &PingResponse{
+		Live:      live,
+		TTL:       ttl,
+		Deadline:  deadline,
+		ExpiresIn: int64(deadline.Sub(t).Seconds()),
+	}
 }
 
-func deleteExpiredTokensDaily() {
-	t := time.NewTicker(24 * time.Hour)
-	for range t.C {
-		deleteExpiredTokens()
+// scopeAllowed reports whether doc may be used for scope. Tokens created
+// without scopes are unrestricted.
+func scopeAllowed(doc interface{}, scope string) bool {
+	scopes, err := ei.N(doc).M("scopes").Slice()
+	if err != nil {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
 	}
+	return false
+}
+
+// isObject reports whether v, a decoded JSON param, is an object.
+func isObject(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
 }
 
-func deleteExpiredTokens() (int, *nxsugar.JsonRpcErr) {
-	countTokensDeleted := 0
-	ret, err := r.Table("tokens").Filter(r.Row.Field("ttl").Eq(0)).Delete(r.DeleteOpts{ReturnChanges: true}).RunWrite(db)
+// stringSlice converts an optional array param into a []string.
+func stringSlice(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	items, err := ei.N(v).Slice()
 	if err != nil {
-		srv.Log(nxsugar.ErrorLevel, "Error deleting tokens with ttl=0. %v", err)
-		return 0, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		return nil, err
+	}
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		str, err := ei.N(item).String()
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+func otpHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+	srv.Log(nxsugar.InfoLevel, "Creating OTP for %s", task.User)
+
+	ttl := ei.N(task.Params).M("ttl").IntZ()
+	if ttl == 0 {
+		ttl = opts.OTPTTL
+	}
+	if ttl < unlimitedTTL || ttl > opts.MaxTTL {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("ttl must be %d (unlimited) or between 1 and %d", unlimitedTTL, opts.MaxTTL)}
 	}
-	countTokensDeleted += len(ret.Changes)
-	srv.Log(nxsugar.ErrorLevel, "Tokens with no more ttl deleted: %v", countTokensDeleted)
 
-	ret, err = r.Table("tokens").
-		Filter(r.Row.Field("deadline").Lt(r.Now())).
-		Delete(r.DeleteOpts{ReturnChanges: true}).RunWrite(db)
+	t, err := dbNow()
 	if err != nil {
-		srv.Log(nxsugar.ErrorLevel, "Error deleting expired tokens. %v", err)
-		return 0, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		return nil, dbError(err)
+	}
+
+	// The lifetime can be given either as seconds from now or as an absolute deadline.
+	deadline := t.Add(opts.OTPLifetime)
+	seconds := ei.N(task.Params).M("ttl_seconds").RawZ()
+	absolute := ei.N(task.Params).M("deadline").RawZ()
+	switch {
+	case seconds != nil && absolute != nil:
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Only one of ttl_seconds or deadline is allowed"}
+	case seconds != nil:
+		secs, err := ei.N(seconds).Int()
+		if err != nil {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlineParse, Mess: "Deadline conversion error"}
+		}
+		deadline = t.Add(time.Duration(secs) * time.Second)
+	case absolute != nil:
+		deadline, err = ei.N(absolute).Time()
+		if err != nil {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlineParse, Mess: "Deadline conversion error"}
+		}
+	}
+	if !deadline.After(t) {
+		return nil, &nxsugar.JsonRpcErr{Cod: errDeadlinePast, Mess: "Deadline is in the past"}
+	}
+	if seconds != nil || absolute != nil {
+		var jerr *nxsugar.JsonRpcErr
+		if deadline, jerr = limitLifetime(deadline, t); jerr != nil {
+			return nil, jerr
+		}
+	}
+
+	token, err := insertOTP(task, ei.M{"user": task.User, "ttl": ttl, "deadline": deadline})
+	if err == nil {
+		audit(task, "otp", task.User, hashToken(token))
+		return token, nil
+	}
+
+	return nil, storeFailed(err)
+}
+
+func createHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	if jerr := checkCreateTag(task); jerr != nil {
+		return nil, jerr
+	}
+
+	t, err := dbNow()
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	doc, jerr := newTokenDoc(task, task.Params, t)
+	if jerr != nil {
+		return nil, jerr
+	}
+	user := doc["user"].(string)
+	doc["created"] = t
+	if jerr := checkTokenQuota(task, []ei.M{doc}, 0); jerr != nil {
+		return nil, jerr
+	}
+
+	token, err := insertToken(task, doc)
+	if err == nil {
+		srv.Log(nxsugar.InfoLevel, "Creating token for %s", user)
+		audit(task, "create", user, hashToken(token))
+
+		// The bare token is returned unless the caller asks for the stored document.
+		if ei.N(task.Params).M("return_full").BoolZ() {
+			doc["id"] = tokenKey(token)
+			doc["token"] = token
+			if jerr := decryptTokens([]interface{}{map[string]interface{}(doc)}); jerr != nil {
+				return nil, jerr
+			}
+			return doc, nil
+		}
+		return token, nil
+	}
+
+	return nil, storeFailed(err)
+}
+
+// storeFailed maps an error storing tokens to the response. Errors RethinkDB reported
+// for the documents are returned to the caller; the rest go through dbError.
+func storeFailed(err error) *nxsugar.JsonRpcErr {
+	if _, ok := err.(writeError); ok {
+		return &nxsugar.JsonRpcErr{Cod: errStoreFailed, Mess: err.Error()}
+	}
+	return dbError(err)
+}
+
+// batchCreateHandler creates one token per entry of the tokens param in a single
+// insert. Every entry is validated like a create call before anything is stored,
+// so an invalid entry fails the whole batch. Batches are capped at --max-info-ids.
+func batchCreateHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	specs, err := ei.N(task.Params).M("tokens").Slice()
+	if err != nil || len(specs) == 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "tokens must be a non-empty array"}
+	}
+	if len(specs) > opts.MaxInfoIDs {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("At most %d tokens are allowed", opts.MaxInfoIDs)}
+	}
+
+	if jerr := checkCreateTag(task); jerr != nil {
+		return nil, jerr
+	}
+
+	t, err := dbNow()
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	docs := make([]ei.M, 0, len(specs))
+	for i, spec := range specs {
+		doc, jerr := newTokenDoc(task, spec, t)
+		if jerr != nil {
+			jerr.Mess = fmt.Sprintf("tokens[%d]: %s", i, jerr.Mess)
+			return nil, jerr
+		}
+		docs = append(docs, doc)
+	}
+	if jerr := checkTokenQuota(task, docs, 0); jerr != nil {
+		return nil, jerr
+	}
+
+	tokens, err := insertTokens(task, docs)
+	if err != nil {
+		return nil, storeFailed(err)
+	}
+
+	for i, doc := range docs {
+		user := doc["user"].(string)
+		srv.Log(nxsugar.InfoLevel, "Creating token for %s", user)
+		audit(task, "create", user, hashToken(tokens[i]))
+	}
+	return tokens, nil
+}
+
+// checkTokenQuota enforces --max-tokens-per-user on the users docs are created for,
+// counting their live tokens through the user index. Tokens created by impersonation
+// are subject to --max-tokens-impersonated instead. A limit of 0 disables its check.
+// replaced is the number of those live tokens the docs take the place of, which are
+// still counted because they are only claimed afterwards.
+// The count and the insert aren't atomic, so concurrent creates may overshoot the
+// quota slightly.
+func checkTokenQuota(task *nxsugar.Task, docs []ei.M, replaced int) *nxsugar.JsonRpcErr {
+	if opts.MaxTokensPerUser <= 0 && opts.MaxTokensImpersonated <= 0 {
+		return nil
+	}
+	created := make(map[string]int)
+	for _, doc := range docs {
+		created[doc["user"].(string)]++
+	}
+	for user, n := range created {
+		limit := opts.MaxTokensPerUser
+		if user != task.User {
+			limit = opts.MaxTokensImpersonated
+		}
+		if limit <= 0 {
+			continue
+		}
+		cur, err := activeTokens(tokensTable(task).GetAllByIndex("user", user)).Count().Run(db)
+		if err != nil {
+			return dbError(err)
+		}
+		var count int
+		err = cur.One(&count)
+		cur.Close()
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+			return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+		if count-replaced+n > limit {
+			return &nxsugar.JsonRpcErr{Cod: errQuotaExceeded, Mess: fmt.Sprintf("%s would exceed its quota of %d live tokens", user, limit)}
+		}
+	}
+	return nil
+}
+
+// checkCreateTag enforces --require-create-tag: the caller needs @sys.login.token.create
+// (or @admin) on its own path to create tokens.
+func checkCreateTag(task *nxsugar.Task) *nxsugar.JsonRpcErr {
+	if !opts.RequireCreate {
+		return nil
+	}
+	allowed, err := hasPathTag(task, task.User, "@sys.login.token.create")
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	return nil
+}
+
+// newTokenDoc validates the creation params of a token and builds the document to store.
+func newTokenDoc(task *nxsugar.Task, params interface{}, t time.Time) (ei.M, *nxsugar.JsonRpcErr) {
+
+	ttl := ei.N(params).M("ttl").IntZ()
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	if ttl < unlimitedTTL || ttl > opts.MaxTTL {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("ttl must be %d (unlimited) or between 1 and %d", unlimitedTTL, opts.MaxTTL)}
+	}
+
+	// A missing deadline gets the --default-deadline lifetime, only a present
+	// but malformed one is a conversion error.
+	deadline := t.Add(opts.DefaultDeadline)
+	if ei.N(params).M("deadline").RawZ() != nil {
+		var err error
+		deadline, err = ei.N(params).M("deadline").Time()
+		if err != nil {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlineParse, Mess: "Deadline conversion error"}
+		}
+		if deadline.Before(t) {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlinePast, Mess: "Deadline is in the past"}
+		}
+		var jerr *nxsugar.JsonRpcErr
+		if deadline, jerr = limitLifetime(deadline, t); jerr != nil {
+			return nil, jerr
+		}
+	}
+
+	user := task.User
+	userToImpersonate := ei.N(params).M("user_to_impersonate").StringZ()
+
+	if userToImpersonate != "" {
+		response, err := task.GetConn().UserGetEffectiveTags(user, userToImpersonate)
+		if err != nil {
+			return nil, &nxsugar.JsonRpcErr{Cod: errImpersonation, Mess: err.Error()}
+		}
+		// A response without tags is malformed; an absent or non boolean @admin
+		// simply isn't granted.
+		tags, err := ei.N(response).M("tags").MapStr()
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error parsing effective tags of %s over %s: %v", user, userToImpersonate, err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+		if !ei.N(tags).M("@admin").BoolZ() {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+		user = userToImpersonate
+		if !userExists(task, user) {
+			return nil, &nxsugar.JsonRpcErr{Cod: errUnknownUser, Mess: "Unknown user to impersonate"}
+		}
+	}
+
+	scopes, err := stringSlice(ei.N(params).M("scopes").RawZ())
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Scopes must be an array of strings"}
+	}
+	tags, err := stringSlice(ei.N(params).M("tags").RawZ())
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Tags must be an array of strings"}
+	}
+
+	fingerprint := ei.N(params).M("bound_fingerprint").RawZ()
+	if _, ok := fingerprint.(string); fingerprint != nil && (!ok || fingerprint == "") {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "bound_fingerprint must be a non-empty string"}
+	}
+
+	raw := ei.N(params).M("metadata").RawZ()
+	if raw != nil && !isObject(raw) {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Metadata must be an object"}
+	}
+	if jerr := reservedMetadata(raw); jerr != nil {
+		return nil, jerr
+	}
+	if jerr := validateMetadata(raw); jerr != nil {
+		return nil, jerr
+	}
+	metadata, err := encryptMetadata(raw)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error encrypting token metadata: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+	doc := ei.M{"user": user, "ttl": ttl, "deadline": deadline, "metadata": metadata}
+	if len(scopes) > 0 {
+		doc["scopes"] = scopes
+	}
+	if len(tags) > 0 {
+		doc["tags"] = tags
+	}
+	if fingerprint != nil {
+		doc["bound_fingerprint"] = fingerprint
+	}
+	parent, jerr := parentKey(task, params)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if parent != "" {
+		doc["parent"] = parent
+	}
+	if ei.N(params).M("max_uses").RawZ() != nil {
+		maxUses, err := ei.N(params).M("max_uses").Int()
+		if err != nil || maxUses < 1 {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "max_uses must be a positive integer"}
+		}
+		doc["max_uses"] = maxUses
+		doc["use_count"] = 0
+	}
+	return doc, nil
+}
+
+// limitLifetime enforces --max-lifetime on a deadline requested at t: deadlines beyond
+// it are rejected, or clamped to it with --clamp-lifetime.
+func limitLifetime(deadline, t time.Time) (time.Time, *nxsugar.JsonRpcErr) {
+	if opts.MaxLifetime <= 0 || !deadline.After(t.Add(opts.MaxLifetime)) {
+		return deadline, nil
+	}
+	if !opts.ClampLifetime {
+		return deadline, &nxsugar.JsonRpcErr{Cod: errLifetimeExceeded, Mess: fmt.Sprintf("Deadline exceeds the maximum lifetime of %v", opts.MaxLifetime)}
+	}
+	return t.Add(opts.MaxLifetime), nil
+}
+
+func consumeHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	match := r.Expr(true)
+	if ei.N(task.Params).M("expect_metadata").RawZ() != nil {
+		expected, err := ei.N(task.Params).M("expect_metadata").MapStr()
+		if err != nil {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "expect_metadata must be an object"}
+		}
+		if metadataEncrypted() {
+			return nil, errMetadataEncrypted()
+		}
+		for k, v := range expected {
+			match = match.And(r.Row.Field("metadata").Field(k).Default(nil).Eq(v))
+		}
+	}
+
+	// Replacing with null deletes the token, or it becomes a tombstone when they are
+	// retained. The checks and the replace run atomically on the document so a
+	// mismatch never consumes it and neither a tombstone nor a revoked, expired or
+	// exhausted token can be consumed.
+	var consumed interface{}
+	if opts.TombstoneRetention > 0 {
+		consumed = r.Row.Merge(tombstone("consumed"))
+	}
+	dead := r.Row.Field("ttl").Eq(0).Or(r.Row.Field("deadline").Lt(r.Now())).Or(usesLeft(r.Row).Not())
+	key := tokenKey(token)
+	ret, err := tokensTable(task).Get(key).
+		Replace(r.Branch(r.Row.Eq(nil).Or(r.Row.HasFields("status")).Or(dead), r.Row, match, consumed, r.Row),
+			r.ReplaceOpts{ReturnChanges: true}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	if len(ret.Changes) != 1 {
+		if ret.Unchanged == 1 {
+			if doc, jerr := getToken(task, key); jerr == nil && !tombstoned(doc) && tokenStatus(doc, time.Now()).Live {
+				return nil, &nxsugar.JsonRpcErr{Cod: errMetadataMismatch, Mess: "Token metadata mismatch"}
+			}
+		}
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	old := ret.Changes[0].OldValue
+	audit(task, "consume", ei.N(old).M("user").StringZ(), tokenRef(old))
+	if jerr := cascadeRevocation(task, key); jerr != nil {
+		return nil, jerr
+	}
+	return decryptedToken(ret.Changes[0].NewValue)
+}
+
+// defaultListLimit bounds list pages when the caller doesn't ask for a limit.
+const defaultListLimit = 100
+
+// authzOwner is reported as the authorization of callers accessing their own tokens.
+const authzOwner = "owner"
+
+// listTag lets callers read other users' tokens. info used to check legacyListTag
+// instead; both are accepted by list and info until legacyListTag is removed.
+const (
+	listTag       = "@sys.login.token.list"
+	legacyListTag = "@token.list"
+)
+
+// listTags are the tags accepted by list and info, in the order they are reported.
+var listTags = []string{listTag, legacyListTag}
+
+type ListResponse struct {
+	Tokens       []interface{} `json:"tokens"`
+	Total        int           `json:"total"`
+	AuthorizedBy string        `json:"authorized_by,omitempty"`
+}
+
+func listHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	limit := ei.N(task.Params).M("limit").IntZ()
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	skip := ei.N(task.Params).M("skip").IntZ()
+	if skip < 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "skip must not be negative"}
+	}
+
+	stmt, authz, jerr := tokensQuery(task)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if authz == "" {
+		return nil, nil
+	}
+
+	switch status := ei.N(task.Params).M("status").StringZ(); status {
+	case "", "active":
+		stmt = activeTokens(stmt)
+	case "expired":
+		stmt = expiredTokens(stmt)
+	case "all":
+	default:
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "status must be active, expired or all"}
+	}
+
+	res, err := stmt.Count().Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	var total int
+	if err := res.One(&total); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	// Neither the user index nor a filter guarantee an order, so pages are sorted by
+	// id to keep them from repeating or skipping tokens.
+	res, err = stmt.OrderBy("id").Skip(skip).Limit(limit).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	tokens := []interface{}{}
+	if err := res.All(&tokens); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	if jerr := decryptTokens(tokens); jerr != nil {
+		return nil, jerr
+	}
+	resp := &ListResponse{Tokens: tokens, Total: total}
+	if ei.N(task.Params).M("include_authorization").BoolZ() {
+		resp.AuthorizedBy = authz
+	}
+	return resp, nil
+}
+
+// tokensQuery selects the tokens resolved by tokensOwner, with the same authz.
+func tokensQuery(task *nxsugar.Task) (stmt r.Term, authz string, jerr *nxsugar.JsonRpcErr) {
+	stmt = tokensTable(task)
+
+	user, path, authz, jerr := tokensOwner(task)
+	if jerr != nil || authz == "" {
+		return stmt, authz, jerr
+	}
+	if path != "" {
+		return underPath(stmt, path), authz, nil
+	}
+	return stmt.GetAllByIndex("user", user), authz, nil
+}
+
+// underPath filters stmt down to the tokens of the users under path.
+func underPath(stmt r.Term, path string) r.Term {
+	return stmt.Between(path, path+"\uffff", r.BetweenOpts{Index: "user"}).
+		Filter(userUnderPath(path))
+}
+
+// userUnderPath matches the tokens of path itself and of the users below it, but not
+// of siblings sharing its prefix. It filters selections already narrowed through
+// another index, which underPath can't follow.
+func userUnderPath(path string) r.Term {
+	return r.Row.Field("user").Match(userPathPattern(path))
+}
+
+// userPathPattern is the regular expression of the users under path.
+func userPathPattern(path string) string {
+	return "^" + regexp.QuoteMeta(path) + `($|\.)`
+}
+
+// tokensOwner resolves whose tokens the caller asks for: its own, those of the user
+// param, or those of the users under the path param (returned in path), the last two
+// only when it holds @admin or listTag over them. authz tells what granted access:
+// authzOwner for the caller's own tokens, the tag otherwise, or empty if access is
+// denied.
+func tokensOwner(task *nxsugar.Task) (user, path, authz string, jerr *nxsugar.JsonRpcErr) {
+
+	if user = ei.N(task.Params).M("user").StringZ(); user != "" && user != task.User {
+		tag, err := listTagOver(task, user)
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error: %v", err)
+			return "", "", "", &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+		return user, "", tag, nil
+	}
+	if path = ei.N(task.Params).M("path").StringZ(); path != "" {
+		tag, err := listTagOver(task, path)
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error: %v", err)
+			return "", "", "", &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+		return "", path, tag, nil
+	}
+
+	return task.User, "", authzOwner, nil
+}
+
+// expiringHandler returns the live tokens of the caller, or of the user or path param as
+// in list, whose deadline falls within the next within seconds, soonest first. Only
+// the fields needed to notify their owners are returned.
+func expiringHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	within, err := ei.N(task.Params).M("within").Int()
+	if err != nil || within <= 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "within must be a positive number of seconds"}
+	}
+	limit := ei.N(task.Params).M("limit").IntZ()
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	user, path, authz, jerr := tokensOwner(task)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if authz == "" {
+		return nil, nil
+	}
+
+	stmt := tokensTable(task).
+		Between(r.Now(), r.Now().Add(within), r.BetweenOpts{Index: "deadline", RightBound: "closed"}).
+		OrderBy(r.OrderByOpts{Index: "deadline"}).
+		Filter(r.Row.Field("ttl").Ne(0)).
+		Filter(usesLeft(r.Row))
+	if path != "" {
+		stmt = stmt.Filter(userUnderPath(path))
+	} else {
+		stmt = stmt.Filter(ei.M{"user": user})
+	}
+
+	res, err := stmt.Limit(limit).Pluck("id", "user", "deadline", "ttl").Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	tokens := []interface{}{}
+	if err := res.All(&tokens); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	return tokens, nil
+}
+
+// listTagOver returns the tag that lets the caller read the tokens under path, warning
+// when only the deprecated legacyListTag does.
+func listTagOver(task *nxsugar.Task, path string) (string, error) {
+	tag, err := pathTag(task, path, listTags...)
+	if tag == legacyListTag {
+		srv.Log(nxsugar.WarnLevel, "%s read tokens of %s with deprecated tag %s, grant %s instead", task.User, path, legacyListTag, listTag)
+	}
+	return tag, err
+}
+
+// activeTokens filters stmt down to tokens that can still be used to log in.
+func activeTokens(stmt r.Term) r.Term {
+	return stmt.Filter(r.Row.Field("ttl").Ne(0)).Filter(r.Row.Field("deadline").Ge(r.Now())).Filter(usesLeft(r.Row))
+}
+
+// expiredTokens filters stmt down to tokens that can no longer be used to log in.
+func expiredTokens(stmt r.Term) r.Term {
+	return stmt.Filter(r.Row.Field("ttl").Eq(0).Or(r.Row.Field("deadline").Lt(r.Now())).Or(usesLeft(r.Row).Not()))
+}
+
+// usesLeft is true for tokens created without max_uses or whose use_count hasn't
+// reached it yet.
+func usesLeft(row r.Term) r.Term {
+	return row.HasFields("max_uses").Not().Or(row.Field("use_count").Lt(row.Field("max_uses")))
+}
+
+// usersHandler returns the distinct users holding at least one live token, sorted,
+// optionally only those under the path param. The caller needs @admin or listTag
+// over the path, the root path when absent.
+func usersHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	path := ei.N(task.Params).M("path").StringZ()
+	tag, err := listTagOver(task, path)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if tag == "" {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	stmt := tokensTable(task)
+	if path != rootPath {
+		stmt = underPath(stmt, path)
+	}
+	res, err := activeTokens(stmt).Field("user").Distinct().Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	users := []string{}
+	if err := res.All(&users); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+	return users, nil
+}
+
+func countHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	stmt, authz, jerr := tokensQuery(task)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if authz == "" {
+		return nil, nil
+	}
+	stmt = activeTokens(stmt)
+
+	if ei.N(task.Params).M("group_by_user").BoolZ() {
+		res, err := stmt.Group("user").Count().Run(db)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		defer res.Close()
+		var groups []struct {
+			Group     string `gorethink:"group"`
+			Reduction int    `gorethink:"reduction"`
+		}
+		if err := res.All(&groups); err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+		counts := make(map[string]int, len(groups))
+		for _, g := range groups {
+			counts[g.Group] = g.Reduction
+		}
+		return counts, nil
+	}
+
+	res, err := stmt.Count().Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	var count int
+	if err := res.One(&count); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	return count, nil
+}
+
+func searchHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	match, err := ei.N(task.Params).M("metadata_match").MapStr()
+	if err != nil || len(match) == 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "metadata_match must be a non-empty object"}
+	}
+	if metadataEncrypted() {
+		return nil, errMetadataEncrypted()
+	}
+	limit := ei.N(task.Params).M("limit").IntZ()
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	stmt, authz, jerr := tokensQuery(task)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if authz == "" {
+		return nil, nil
+	}
+
+	res, err := metadataMatching(stmt, match).Limit(limit).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	tokens := []interface{}{}
+	if err := res.All(&tokens); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	return tokens, nil
+}
+
+// metadataMatching filters stmt down to the tokens whose metadata holds every field
+// of match with the same value.
+func metadataMatching(stmt r.Term, match map[string]interface{}) r.Term {
+	fields := make([]interface{}, 0, len(match))
+	for k := range match {
+		fields = append(fields, k)
+	}
+	stmt = stmt.Filter(r.Row.HasFields("metadata")).
+		Filter(r.Row.Field("metadata").HasFields(fields...))
+	for k, v := range match {
+		stmt = stmt.Filter(r.Row.Field("metadata").Field(k).Eq(v))
+	}
+	return stmt
+}
+
+// expireByMetadataHandler revokes every live token whose metadata matches the
+// metadata_match param like in search, optionally only among the users under the path
+// param, and returns how many were revoked. It is meant for incident response, e.g.
+// to kill the tokens of a compromised client version, and requires @admin over the
+// path, the root path when absent.
+func expireByMetadataHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	match, err := ei.N(task.Params).M("metadata_match").MapStr()
+	if err != nil || len(match) == 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "metadata_match must be a non-empty object"}
+	}
+	if metadataEncrypted() {
+		return nil, errMetadataEncrypted()
+	}
+	path := ei.N(task.Params).M("path").StringZ()
+
+	allowed, err := hasPathTag(task, path)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	stmt := tokensTable(task)
+	if path != rootPath {
+		stmt = underPath(stmt, path)
+	}
+	n, jerr := revokeAll(task, metadataMatching(stmt, match))
+	if jerr != nil {
+		return nil, jerr
+	}
+
+	srv.Log(nxsugar.InfoLevel, "Tokens matching metadata %v under %q revoked by %s: %d", match, path, task.User, n)
+	audit(task, "expire_by_metadata", path, "")
+	return n, nil
+}
+
+// listByTagHandler returns the live tokens labelled with the tag param, among those of
+// the caller or of the user or path param as in list.
+func listByTagHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	tag := ei.N(task.Params).M("tag").StringZ()
+	if tag == "" {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "tag is required"}
+	}
+	limit := ei.N(task.Params).M("limit").IntZ()
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	user, path, authz, jerr := tokensOwner(task)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if authz == "" {
+		return nil, nil
+	}
+
+	stmt := tokensTable(task).GetAllByIndex("tags", tag)
+	if path != "" {
+		stmt = stmt.Filter(userUnderPath(path))
+	} else {
+		stmt = stmt.Filter(ei.M{"user": user})
+	}
+
+	res, err := activeTokens(stmt).Limit(limit).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	tokens := []interface{}{}
+	if err := res.All(&tokens); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	if jerr := decryptTokens(tokens); jerr != nil {
+		return nil, jerr
+	}
+	return tokens, nil
+}
+
+// rootPath is where service wide operations require the caller's tags.
+const rootPath = ""
+
+type StatsResponse struct {
+	Total        int         `json:"total" gorethink:"total"`
+	Active       int         `json:"active" gorethink:"active"`
+	Exhausted    int         `json:"exhausted" gorethink:"exhausted"`
+	PastDeadline int         `json:"past_deadline" gorethink:"past_deadline"`
+	NextExpiry   interface{} `json:"next_expiry" gorethink:"next_expiry"`
+	AvgTTL       interface{} `json:"avg_ttl" gorethink:"avg_ttl"`
+}
+
+// statsHandler returns aggregate token metrics computed in a single query. avg_ttl
+// only covers tokens with logins left, unlimited ones would skew it.
+func statsHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	allowed, err := hasPathTag(task, rootPath, "@sys.login.token.stats")
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	stats, err := tokenStats(tokensTable(task))
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return stats, nil
+}
+
+// tokenStats computes the aggregate metrics of table in a single query.
+func tokenStats(table r.Term) (*StatsResponse, error) {
+	res, err := r.Expr(ei.M{
+		"total":         table.Count(),
+		"active":        activeTokens(table).Count(),
+		"exhausted":     table.Filter(r.Row.Field("ttl").Eq(0).Or(usesLeft(r.Row).Not())).Count(),
+		"past_deadline": table.Between(r.MinVal, r.Now(), r.BetweenOpts{Index: "deadline"}).Count(),
+		"next_expiry": table.Between(r.Now(), r.MaxVal, r.BetweenOpts{Index: "deadline"}).
+			OrderBy(r.OrderByOpts{Index: "deadline"}).
+			Filter(r.Row.Field("ttl").Ne(0)).Filter(usesLeft(r.Row)).
+			Limit(1).Nth(0).Field("deadline").Default(nil),
+		"avg_ttl": table.Filter(r.Row.Field("ttl").Gt(0)).Avg("ttl").Default(nil),
+	}).Run(db)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	var stats StatsResponse
+	if err := res.One(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+type StatusCounts struct {
+	Active          int `json:"active" gorethink:"active"`
+	DeadlineExpired int `json:"deadline_expired" gorethink:"deadline_expired"`
+	Exhausted       int `json:"exhausted" gorethink:"exhausted"`
+}
+
+// countByStatusHandler counts the tokens, optionally only those of the users under the
+// path param, into disjoint buckets in a single pass: live, past their deadline, and
+// with no logins left before their deadline. It is a cheaper stats for frequent polls
+// and requires @admin or @sys.login.token.stats over the path, the root path when
+// absent.
+func countByStatusHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	path := ei.N(task.Params).M("path").StringZ()
+	allowed, err := hasPathTag(task, path, "@sys.login.token.stats")
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	stmt := tokensTable(task)
+	if path != rootPath {
+		stmt = underPath(stmt, path)
+	}
+	zero := ei.M{"active": 0, "deadline_expired": 0, "exhausted": 0}
+	res, err := stmt.Map(func(row r.Term) interface{} {
+		expired := row.Field("deadline").Lt(r.Now())
+		return r.Branch(
+			expired, ei.M{"active": 0, "deadline_expired": 1, "exhausted": 0},
+			row.Field("ttl").Eq(0).Or(usesLeft(row).Not()), ei.M{"active": 0, "deadline_expired": 0, "exhausted": 1},
+			ei.M{"active": 1, "deadline_expired": 0, "exhausted": 0})
+	}).Reduce(func(left, right r.Term) interface{} {
+		return ei.M{
+			"active":           left.Field("active").Add(right.Field("active")),
+			"deadline_expired": left.Field("deadline_expired").Add(right.Field("deadline_expired")),
+			"exhausted":        left.Field("exhausted").Add(right.Field("exhausted")),
+		}
+	}).Default(zero).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	var counts StatusCounts
+	if err := res.One(&counts); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+	return &counts, nil
+}
+
+func infoHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+	ids, err := stringSlice(ei.N(task.Params).M("ids").RawZ())
+	if err != nil || len(ids) == 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "ids must be a non-empty array of strings"}
+	}
+	if len(ids) > opts.MaxInfoIDs {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("At most %d ids are allowed", opts.MaxInfoIDs)}
+	}
+
+	// Clients pass the tokens they hold, which aren't the stored keys when hashed.
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = tokenKey(id)
+	}
+
+	res, err := tokensTable(task).
+		GetAll(keys...).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+
+	var tokensInfo []interface{}
+	if err := res.All(&tokensInfo); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	user := task.User
+	includeAuthz := ei.N(task.Params).M("include_authorization").BoolZ()
+
+	for _, token := range tokensInfo {
+		authz := authzOwner
+		path := ei.N(token).M("user").StringZ()
+		if path != user {
+			tag, err := listTagOver(task, path)
+			if err != nil {
+				srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+				return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams}
+			}
+			if tag == "" {
+				return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams}
+			}
+			authz = tag
+		}
+		if m, ok := token.(map[string]interface{}); ok && includeAuthz {
+			m["authorized_by"] = authz
+		}
+	}
+
+	if jerr := decryptTokens(tokensInfo); jerr != nil {
+		return nil, jerr
+	}
+	return tokensInfo, nil
+}
+
+func revokeHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	key := tokenKey(token)
+	doc, jerr := getToken(task, key)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if jerr := checkTokenOwner(task, doc, "@sys.login.token.revoke"); jerr != nil {
+		return nil, jerr
+	}
+
+	ret, err := tokensTable(task).GetAll(key).
+		Filter(r.Row.HasFields("status").Not()).
+		Update(revocation(), r.UpdateOpts{ReturnChanges: true}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	if len(ret.Changes) != 1 {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	srv.Log(nxsugar.InfoLevel, "Token revoked by %s", task.User)
+	audit(task, "revoke", ei.N(doc).M("user").StringZ(), tokenRef(doc))
+	if jerr := cascadeRevocation(task, key); jerr != nil {
+		return nil, jerr
+	}
+	return decryptedToken(ret.Changes[0].NewValue)
+}
+
+func renewHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	ttlAdd := ei.N(task.Params).M("ttl_add").IntZ()
+	if ttlAdd < 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "ttl_add must not be negative"}
+	}
+
+	key := tokenKey(token)
+	doc, jerr := getToken(task, key)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if jerr := checkTokenOwner(task, doc, "@sys.login.token.renew"); jerr != nil {
+		return nil, jerr
+	}
+
+	// Unlimited (negative ttl) tokens keep their ttl, the rest are capped at --max-ttl.
+	ttl := r.Row.Field("ttl")
+	update := ei.M{"ttl": r.Branch(ttl.Lt(0), ttl, ttl.Add(ttlAdd).Gt(opts.MaxTTL), opts.MaxTTL, ttl.Add(ttlAdd))}
+
+	if ei.N(task.Params).M("new_deadline").RawZ() != nil {
+		deadline, err := ei.N(task.Params).M("new_deadline").Time()
+		if err != nil {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlineParse, Mess: "Deadline conversion error"}
+		}
+		t, err := dbNow()
+		if err != nil {
+			return nil, dbError(err)
+		}
+		if deadline.Before(t) {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlinePast, Mess: "Deadline is in the past"}
+		}
+		if deadline, jerr = limitLifetime(deadline, t); jerr != nil {
+			return nil, jerr
+		}
+		update["deadline"] = deadline
+	}
+
+	ret, err := activeTokens(tokensTable(task).GetAll(key)).
+		Update(update, r.UpdateOpts{ReturnChanges: "always"}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	if len(ret.Changes) != 1 {
+		return nil, &nxsugar.JsonRpcErr{Cod: errTokenExpired, Mess: "Token expired"}
+	}
+
+	audit(task, "renew", ei.N(doc).M("user").StringZ(), tokenRef(doc))
+	return decryptedToken(ret.Changes[0].NewValue)
+}
+
+// addUsesHandler tops up the remaining uses of a limited token by count, capped at
+// --max-ttl. Unlike renew it never touches the deadline.
+func addUsesHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	count, err := ei.N(task.Params).M("count").Int()
+	if err != nil || count < 1 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "count must be a positive integer"}
+	}
+
+	key := tokenKey(token)
+	doc, jerr := getToken(task, key)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if jerr := checkTokenOwner(task, doc, "@sys.login.token.renew"); jerr != nil {
+		return nil, jerr
+	}
+	if ei.N(doc).M("ttl").IntZ() < 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Token has unlimited uses"}
+	}
+
+	ttl := r.Row.Field("ttl")
+	ret, err := activeTokens(tokensTable(task).GetAll(key)).
+		Filter(ttl.Gt(0)).
+		Update(ei.M{"ttl": r.Branch(ttl.Add(count).Gt(opts.MaxTTL), opts.MaxTTL, ttl.Add(count))}, r.UpdateOpts{ReturnChanges: "always"}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	if len(ret.Changes) != 1 {
+		return nil, &nxsugar.JsonRpcErr{Cod: errTokenExpired, Mess: "Token expired"}
+	}
+
+	audit(task, "add_uses", ei.N(doc).M("user").StringZ(), tokenRef(doc))
+	return decryptedToken(ret.Changes[0].NewValue)
+}
+
+func updateMetadataHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	var update ei.M
+	replace := ei.N(task.Params).M("metadata").RawZ()
+	merge := ei.N(task.Params).M("metadata_merge").RawZ()
+	if (replace != nil && !isObject(replace)) || (merge != nil && !isObject(merge)) {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Metadata must be an object"}
+	}
+	for _, metadata := range []interface{}{replace, merge} {
+		if jerr := reservedMetadata(metadata); jerr != nil {
+			return nil, jerr
+		}
+	}
+	switch {
+	case replace != nil && merge == nil:
+		metadata, err := encryptMetadata(replace)
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error encrypting token metadata: %v", err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+		update = ei.M{"metadata": r.Literal(metadata)}
+	case merge != nil && replace == nil:
+		if metadataEncrypted() {
+			return nil, errMetadataEncrypted()
+		}
+		update = ei.M{"metadata": r.Row.Field("metadata").Default(ei.M{}).Merge(merge)}
+	default:
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Exactly one of metadata or metadata_merge is required"}
+	}
+
+	key := tokenKey(token)
+	doc, jerr := getToken(task, key)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if jerr := checkTokenOwner(task, doc, "@sys.login.token.update"); jerr != nil {
+		return nil, jerr
+	}
+	metadata := replace
+	if merge != nil {
+		metadata = mergedMetadata(doc["metadata"], merge)
+	}
+	if jerr := validateMetadata(metadata); jerr != nil {
+		return nil, jerr
+	}
+
+	ret, err := activeTokens(tokensTable(task).GetAll(key)).
+		Update(update, r.UpdateOpts{ReturnChanges: "always"}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	if len(ret.Changes) != 1 {
+		return nil, &nxsugar.JsonRpcErr{Cod: errTokenExpired, Mess: "Token expired"}
+	}
+
+	return decryptedToken(ret.Changes[0].NewValue)
+}
+
+// transferHandler reassigns a live token to new_user. The caller needs @admin over
+// both the current and the new owner.
+func transferHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+	newUser, err := ei.N(task.Params).M("new_user").String()
+	if err != nil || newUser == "" {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "new_user is required"}
+	}
+
+	key := tokenKey(token)
+	doc, jerr := getToken(task, key)
+	if jerr != nil {
+		return nil, jerr
+	}
+	owner := ei.N(doc).M("user").StringZ()
+	for _, path := range []string{owner, newUser} {
+		allowed, err := hasPathTag(task, path)
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+		if !allowed {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+	}
+
+	// The owner is matched again so a concurrent transfer can't be overwritten.
+	ret, err := activeTokens(tokensTable(task).GetAll(key)).
+		Filter(ei.M{"user": owner}).
+		Update(ei.M{"user": newUser}, r.UpdateOpts{ReturnChanges: "always"}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	if len(ret.Changes) != 1 {
+		return nil, &nxsugar.JsonRpcErr{Cod: errTokenExpired, Mess: "Token expired"}
+	}
+
+	srv.Log(nxsugar.InfoLevel, "Token transferred from %s to %s by %s", owner, newUser, task.User)
+	audit(task, "transfer", newUser, tokenRef(doc))
+	return decryptedToken(ret.Changes[0].NewValue)
+}
+
+// bulkRevokeHandler revokes every live token of the user param, or of all users
+// under the path param, returning how many were revoked.
+func bulkRevokeHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	user := ei.N(task.Params).M("user").StringZ()
+	path := ei.N(task.Params).M("path").StringZ()
+	if (user == "") == (path == "") {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Exactly one of user or path is required"}
+	}
+
+	target := user + path
+	if target != task.User || path != "" {
+		allowed, err := hasPathTag(task, target, "@sys.login.token.revoke")
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+		if !allowed {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+	}
+
+	var stmt r.Term
+	if user != "" {
+		stmt = tokensTable(task).GetAllByIndex("user", user)
+	} else {
+		stmt = underPath(tokensTable(task), path)
+	}
+
+	n, jerr := revokeAll(task, stmt)
+	if jerr != nil {
+		return nil, jerr
+	}
+
+	srv.Log(nxsugar.InfoLevel, "Tokens of %s revoked by %s: %d", target, task.User, n)
+	audit(task, "bulk_revoke", target, "")
+	return n, nil
+}
+
+// bulkExtendHandler pushes back the deadline of every live token of the user param, or
+// of all users under the path param, to the deadline param or by delta seconds, and
+// returns how many were extended. Deadlines never move earlier and, with
+// --max-lifetime, are capped at that long after each token's creation. It requires
+// @admin over the user or path.
+func bulkExtendHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	user := ei.N(task.Params).M("user").StringZ()
+	path := ei.N(task.Params).M("path").StringZ()
+	if (user == "") == (path == "") {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Exactly one of user or path is required"}
+	}
+	hasDeadline := ei.N(task.Params).M("deadline").RawZ() != nil
+	hasDelta := ei.N(task.Params).M("delta").RawZ() != nil
+	if hasDeadline == hasDelta {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Exactly one of deadline or delta is required"}
+	}
+
+	var deadline r.Term
+	if hasDeadline {
+		d, err := ei.N(task.Params).M("deadline").Time()
+		if err != nil {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlineParse, Mess: "Deadline conversion error"}
+		}
+		t, err := dbNow()
+		if err != nil {
+			return nil, dbError(err)
+		}
+		if !d.After(t) {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlinePast, Mess: "Deadline is in the past"}
+		}
+		deadline = r.Expr(d)
+	} else {
+		delta, err := ei.N(task.Params).M("delta").Int()
+		if err != nil || delta <= 0 {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "delta must be a positive number of seconds"}
+		}
+		deadline = r.Row.Field("deadline").Add(delta)
+	}
+
+	target := user + path
+	allowed, err := hasPathTag(task, target)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	// Tokens issued before creation times were recorded are capped from now instead.
+	if opts.MaxLifetime > 0 {
+		limit := r.Row.Field("created").Default(r.Now()).Add(opts.MaxLifetime.Seconds())
+		deadline = r.Branch(deadline.Gt(limit), limit, deadline)
+	}
+	current := r.Row.Field("deadline")
+	update := ei.M{"deadline": r.Branch(deadline.Gt(current), deadline, current)}
+
+	var stmt r.Term
+	if user != "" {
+		stmt = tokensTable(task).GetAllByIndex("user", user)
+	} else {
+		stmt = underPath(tokensTable(task), path)
+	}
+	ret, err := withoutTombstones(activeTokens(stmt)).Update(update).RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	srv.Log(nxsugar.InfoLevel, "Tokens of %s extended by %s: %d", target, task.User, ret.Replaced)
+	audit(task, "bulk_extend", target, "")
+	return ret.Replaced, nil
+}
+
+// revokeAll revokes the live tokens selected by stmt and their descendants, and
+// returns how many tokens of stmt were revoked.
+func revokeAll(task *nxsugar.Task, stmt r.Term) (int, *nxsugar.JsonRpcErr) {
+	ret, err := activeTokens(stmt).Update(revocation(), r.UpdateOpts{ReturnChanges: true}).RunWrite(db)
+	if err != nil {
+		return 0, dbError(err)
+	}
+	keys := make([]interface{}, len(ret.Changes))
+	for i, change := range ret.Changes {
+		keys[i] = ei.N(change.NewValue).M("id").StringZ()
+	}
+	if jerr := cascadeRevocation(task, keys...); jerr != nil {
+		return 0, jerr
+	}
+	return ret.Replaced, nil
+}
+
+// findBySessionHandler returns every token whose metadata holds the session_id param,
+// using the session_id index. It requires @admin.
+func findBySessionHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	sessionID := ei.N(task.Params).M("session_id").StringZ()
+	if sessionID == "" {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "session_id is required"}
+	}
+	if metadataEncrypted() {
+		return nil, errMetadataEncrypted()
+	}
+
+	allowed, err := hasPathTag(task, rootPath)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	res, err := tokensTable(task).GetAllByIndex("session_id", sessionID).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	tokens := []interface{}{}
+	if err := res.All(&tokens); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	return tokens, nil
+}
+
+// purgeUserHandler deletes every token of the user param whatever its status,
+// returning how many were deleted. Unlike bulk_revoke it only matches the exact
+// user, never the users under it, and requires @admin over it.
+func purgeUserHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	user := ei.N(task.Params).M("user").StringZ()
+	if user == "" {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "user is required"}
+	}
+
+	allowed, err := hasPathTag(task, user)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	ret, err := tokensTable(task).GetAllByIndex("user", user).Delete().RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	srv.Log(nxsugar.InfoLevel, "Tokens of %s purged by %s: %d", user, task.User, ret.Deleted)
+	audit(task, "purge_user", user, "")
+	return ret.Deleted, nil
+}
+
+// maxExportLimit caps the page size of export.
+const maxExportLimit = 1000
+
+type ExportResponse struct {
+	Tokens []interface{} `json:"tokens"`
+	Next   string        `json:"next,omitempty"`
+}
+
+// exportHandler pages through every token of the table, whatever its status, in
+// primary key order for backups. Documents are returned as stored, with their metadata
+// still encrypted, so they can be restored as they were. The next page starts after
+// the after param, which callers set to the next field of the previous page; next is
+// empty on the last one. It requires @admin on the root path and every call is logged.
+func exportHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	limit := ei.N(task.Params).M("limit").IntZ()
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxExportLimit {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("limit must not exceed %d", maxExportLimit)}
+	}
+	after := ei.N(task.Params).M("after").StringZ()
+
+	allowed, err := hasPathTag(task, rootPath)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		srv.Log(nxsugar.WarnLevel, "Export denied to %s", task.User)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	stmt := tokensTable(task)
+	if after != "" {
+		stmt = stmt.Between(after, r.MaxVal, r.BetweenOpts{LeftBound: "open"})
+	}
+	res, err := stmt.OrderBy(r.OrderByOpts{Index: "id"}).Limit(limit).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer res.Close()
+	tokens := []interface{}{}
+	if err := res.All(&tokens); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+
+	resp := &ExportResponse{Tokens: tokens}
+	if len(tokens) == limit {
+		resp.Next = ei.N(tokens[limit-1]).M("id").StringZ()
+	}
+	srv.Log(nxsugar.InfoLevel, "Export of %d tokens after %q by %s", len(tokens), after, task.User)
+	return resp, nil
+}
+
+// importTimeFields are the time fields of a token document, which arrive as strings
+// in an import and are stored back as times.
+var importTimeFields = []string{"deadline", "created", "lastSeen", "consumedAt", "revokedAt"}
+
+// importConflicts maps the conflict param of import to how existing ids are handled.
+var importConflicts = map[string]interface{}{
+	"error":     "error",
+	"overwrite": "replace",
+	"skip": func(id, old, new r.Term) interface{} {
+		return old
+	},
+}
+
+type ImportError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type ImportResponse struct {
+	Inserted   int           `json:"inserted"`
+	Replaced   int           `json:"replaced"`
+	Skipped    int           `json:"skipped"`
+	Conflicts  int           `json:"conflicts"`
+	FirstError string        `json:"first_error,omitempty"`
+	Invalid    []ImportError `json:"invalid,omitempty"`
+}
+
+// importHandler restores token documents, such as those returned by export, keeping
+// their ids, which every entry must have. Malformed entries are reported in invalid by
+// index and the rest are stored in a single insert. The conflict param tells what to
+// do with ids already in the table: error (the default) leaves them and counts them in
+// conflicts, skip leaves them silently and overwrite replaces them. It requires @admin
+// on the root path and every call is logged.
+func importHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	entries, err := ei.N(task.Params).M("tokens").Slice()
+	if err != nil || len(entries) == 0 {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "tokens must be a non-empty array"}
+	}
+	if len(entries) > maxExportLimit {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("tokens must not hold more than %d entries", maxExportLimit)}
+	}
+	mode := ei.N(task.Params).M("conflict").StringZ()
+	if mode == "" {
+		mode = "error"
+	}
+	conflict, ok := importConflicts[mode]
+	if !ok {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "conflict must be error, skip or overwrite"}
+	}
+
+	allowed, err := hasPathTag(task, rootPath)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		srv.Log(nxsugar.WarnLevel, "Import denied to %s", task.User)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	t, err := dbNow()
+	if err != nil {
+		return nil, dbError(err)
+	}
+	resp := &ImportResponse{}
+	docs := make([]ei.M, 0, len(entries))
+	for i, entry := range entries {
+		doc, err := importDoc(entry, t)
+		if err != nil {
+			resp.Invalid = append(resp.Invalid, ImportError{Index: i, Error: err.Error()})
+			continue
+		}
+		docs = append(docs, doc)
+	}
+
+	if len(docs) > 0 {
+		ret, err := tokensTable(task).Insert(docs, r.InsertOpts{Conflict: conflict}).RunWrite(db)
+		if err != nil {
+			return nil, dbError(err)
+		}
+		resp.Inserted = ret.Inserted
+		resp.Replaced = ret.Replaced
+		resp.Skipped = ret.Unchanged
+		resp.Conflicts = ret.Errors
+		resp.FirstError = ret.FirstError
+	}
+
+	srv.Log(nxsugar.InfoLevel, "Import of %d tokens by %s: %d inserted, %d replaced, %d skipped, %d conflicts, %d invalid",
+		len(entries), task.User, resp.Inserted, resp.Replaced, resp.Skipped, resp.Conflicts, len(resp.Invalid))
+	return resp, nil
+}
+
+// importDoc validates an entry of import at time t and returns the document to store.
+// The id is required: a key RethinkDB generated would never reach the client, and
+// with --hash-tokens it wouldn't even be the hash of a token.
+// Deadlines beyond --max-lifetime from t are handled like on create, so imported tokens
+// are never taken for tampered ones on login, and metadata must match the schema.
+func importDoc(entry interface{}, t time.Time) (ei.M, error) {
+	m, ok := entry.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("entry must be an object")
+	}
+	doc := make(ei.M, len(m))
+	for k, v := range m {
+		doc[k] = v
+	}
+	if id, ok := doc["id"].(string); !ok || id == "" {
+		return nil, errors.New("id must be a non-empty string")
+	}
+	if ei.N(doc).M("user").StringZ() == "" {
+		return nil, errors.New("user is required")
+	}
+	if _, err := ei.N(doc).M("ttl").Int(); err != nil {
+		return nil, errors.New("ttl must be an integer")
+	}
+	if _, ok := doc["deadline"]; !ok {
+		return nil, errors.New("deadline is required")
+	}
+	for _, field := range importTimeFields {
+		if _, ok := doc[field]; !ok {
+			continue
+		}
+		ft, err := ei.N(doc).M(field).Time()
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a time", field)
+		}
+		doc[field] = ft
+	}
+	deadline, jerr := limitLifetime(doc["deadline"].(time.Time), t)
+	if jerr != nil {
+		return nil, errors.New(jerr.Mess)
+	}
+	// Exported metadata may be encrypted, it is validated as the client would see it.
+	plain := map[string]interface{}{"metadata": doc["metadata"]}
+	if err := decryptMetadata(plain); err != nil {
+		return nil, fmt.Errorf("metadata can't be decrypted: %v", err)
+	}
+	if jerr := validateMetadata(plain["metadata"]); jerr != nil {
+		return nil, errors.New(jerr.Mess)
+	}
+	doc["deadline"] = deadline
+	return doc, nil
+}
+
+// refreshHandler replaces a live token with a new one for the same user, keeping its
+// metadata, scopes, tags and uses. The caller must own the token or hold
+// @sys.login.token.renew over its user, and only the latter can raise its ttl above
+// what is left of it. Once every check passed the old token is revoked like revoke
+// does, leaving a tombstone when they are retained. The update is atomic on the
+// document and lets only one concurrent refresh win; the old token is restored if the
+// new one can't be stored. Clients only learn the new token once it is stored, so
+// there is no moment where they hold no valid token or two valid ones.
+func refreshHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	t, err := dbNow()
+	if err != nil {
+		return nil, dbError(err)
+	}
+	var deadline interface{}
+	if ei.N(task.Params).M("deadline").RawZ() != nil {
+		d, err := ei.N(task.Params).M("deadline").Time()
+		if err != nil {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlineParse, Mess: "Deadline conversion error"}
+		}
+		if d.Before(t) {
+			return nil, &nxsugar.JsonRpcErr{Cod: errDeadlinePast, Mess: "Deadline is in the past"}
+		}
+		d, jerr := limitLifetime(d, t)
+		if jerr != nil {
+			return nil, jerr
+		}
+		deadline = d
+	}
+	ttl := ei.N(task.Params).M("ttl").IntZ()
+	if ttl < unlimitedTTL || ttl > opts.MaxTTL {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("ttl must be %d (unlimited) or between 1 and %d", unlimitedTTL, opts.MaxTTL)}
+	}
+
+	if jerr := checkCreateTag(task); jerr != nil {
+		return nil, jerr
+	}
+	key := tokenKey(token)
+	current, jerr := getToken(task, key)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if !tokenMatches(current, token) {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+	owner := ei.N(current).M("user").StringZ()
+	canRenew, err := hasPathTag(task, owner, "@sys.login.token.renew")
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !canRenew && owner != task.User {
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+
+	// Without an explicit ttl the new token starts over like a freshly created one,
+	// unlimited tokens stay unlimited. Without @sys.login.token.renew the ttl can't
+	// grow past the one left on the old token.
+	oldTTL := ei.N(current).M("ttl").IntZ()
+	explicit := ttl != 0
+	if !explicit {
+		ttl = defaultTTL
+		if oldTTL < 0 {
+			ttl = unlimitedTTL
+		}
+	}
+	if !canRenew && oldTTL > 0 && (ttl < 0 || ttl > oldTTL) {
+		if explicit {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied, Mess: fmt.Sprintf("ttl can't exceed the %d left on the token", oldTTL)}
+		}
+		ttl = oldTTL
+	}
+	if deadline == nil {
+		deadline = current["deadline"]
+	}
+	doc := ei.M{"user": owner, "ttl": ttl, "deadline": deadline}
+	if jerr := checkTokenQuota(task, []ei.M{doc}, 1); jerr != nil {
+		return nil, jerr
+	}
+
+	// The owner and ttl are matched again so a concurrent transfer or login can't
+	// slip past the checks above.
+	ret, err := activeTokens(tokensTable(task).GetAll(key)).
+		Filter(ei.M{"user": owner, "ttl": current["ttl"]}).
+		Update(revocation(), r.UpdateOpts{ReturnChanges: true}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	if len(ret.Changes) != 1 || !tokenMatches(ret.Changes[0].OldValue, token) {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+	old, _ := ret.Changes[0].OldValue.(map[string]interface{})
+	doc["metadata"] = old["metadata"]
+	for _, field := range []string{"scopes", "tags", "bound_fingerprint", "parent", "max_uses", "use_count"} {
+		if v, ok := old[field]; ok {
+			doc[field] = v
+		}
+	}
+
+	newToken, err := insertToken(task, doc)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error refreshing token, restoring the old one: %v", err)
+		if _, rerr := tokensTable(task).Get(key).Replace(old).RunWrite(db); rerr != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error restoring refreshed token: %v", rerr)
+		}
+		return nil, storeFailed(err)
+	}
+
+	reparentChildren(task, ei.N(old).M("id").StringZ(), tokenKey(newToken))
+	user := ei.N(old).M("user").StringZ()
+	audit(task, "refresh", user, tokenRef(old))
+	audit(task, "create", user, hashToken(newToken))
+	return newToken, nil
+}
+
+// rotateSecretHandler replaces the secret of a live token, keeping the rest of the
+// document as is: unlike refresh, the remaining ttl, uses and deadline carry over.
+// The old token is claimed by deleting it, which is atomic on the document, and
+// restored if the new one can't be stored.
+func rotateSecretHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+
+	token, err := ei.N(task.Params).M("token").String()
+	if err != nil {
+		return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+	}
+
+	key := tokenKey(token)
+	doc, jerr := getToken(task, key)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if jerr := checkTokenOwner(task, doc, "@sys.login.token.rotate"); jerr != nil {
+		return nil, jerr
+	}
+
+	ret, err := activeTokens(tokensTable(task).GetAll(key)).
+		Delete(r.DeleteOpts{ReturnChanges: true}).
+		RunWrite(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	if len(ret.Changes) != 1 || !tokenMatches(ret.Changes[0].OldValue, token) {
+		return nil, &nxsugar.JsonRpcErr{Cod: errTokenExpired, Mess: "Token expired"}
+	}
+	old, _ := ret.Changes[0].OldValue.(map[string]interface{})
+
+	rotated := ei.M{}
+	for k, v := range old {
+		if k != "id" && k != "alg" {
+			rotated[k] = v
+		}
+	}
+
+	newToken, err := insertToken(task, rotated)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error rotating token secret, restoring the old one: %v", err)
+		if _, rerr := tokensTable(task).Insert(old).RunWrite(db); rerr != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error restoring rotated token: %v", rerr)
+		}
+		return nil, storeFailed(err)
+	}
+
+	reparentChildren(task, ei.N(old).M("id").StringZ(), tokenKey(newToken))
+	user := ei.N(old).M("user").StringZ()
+	audit(task, "rotate", user, tokenRef(old))
+	audit(task, "create", user, hashToken(newToken))
+	return newToken, nil
+}
+
+// getToken fetches the token document stored under key in the task's table.
+func getToken(task *nxsugar.Task, key string) (map[string]interface{}, *nxsugar.JsonRpcErr) {
+	cur, err := tokensTable(task).Get(key).Run(db)
+	if err != nil {
+		return nil, dbError(err)
+	}
+	defer cur.Close()
+	var doc map[string]interface{}
+	if err := cur.One(&doc); err != nil {
+		if err == r.ErrEmptyResult {
+			return nil, &nxsugar.JsonRpcErr{Cod: errInvalidToken, Mess: "Invalid token"}
+		}
+		srv.Log(nxsugar.ErrorLevel, "Error getting query results: %v", err)
+		return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+	}
+	return doc, nil
+}
+
+// checkTokenOwner allows the caller to manage doc if it owns the token or holds
+// @admin or tag over the token's user.
+func checkTokenOwner(task *nxsugar.Task, doc interface{}, tag string) *nxsugar.JsonRpcErr {
+	owner := ei.N(doc).M("user").StringZ()
+	if owner == task.User {
+		return nil
+	}
+	allowed, err := hasPathTag(task, owner, tag)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+		return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	if !allowed {
+		return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+	}
+	return nil
+}
+
+// dbNow returns the current time as seen by RethinkDB.
+func dbNow() (time.Time, error) {
+	var t time.Time
+	cur, err := r.Expr(r.Now()).Run(db)
+	if err != nil {
+		return t, err
+	}
+	defer cur.Close()
+	err = cur.One(&t)
+	return t, err
+}
+
+// userExists checks that nexus knows user by asking for its own effective tags,
+// which fails or comes back without a tags record for unknown users.
+func userExists(task *nxsugar.Task, user string) bool {
+	res, err := task.GetConn().UserGetEffectiveTags(user, user)
+	if err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error getting effective tags of %s: %v", user, err)
+		return false
+	}
+	_, err = ei.N(res).M("tags").MapStr()
+	return err == nil
+}
+
+// hasPathTag reports whether the caller holds @admin or any of tags over path.
+func hasPathTag(task *nxsugar.Task, path string, tags ...string) (bool, error) {
+	tag, err := pathTag(task, path, tags...)
+	return tag != "", err
+}
+
+// pathTag returns which of tags, or else @admin, the caller holds over path, or an
+// empty string if none. The narrower tags are checked first so that @admin is only
+// reported when nothing else would have granted access.
+func pathTag(task *nxsugar.Task, path string, tags ...string) (string, error) {
+	res, err := task.GetConn().UserGetEffectiveTags(task.User, path)
+	if err != nil {
+		return "", err
+	}
+	return heldTag(res, tags...), nil
+}
+
+// heldTag returns which of tags, or else @admin, is granted in res, a response of
+// UserGetEffectiveTags, or an empty string if none.
+func heldTag(res interface{}, tags ...string) string {
+	for _, tag := range append(tags, "@admin") {
+		if ei.N(res).M("tags").M(tag).BoolZ() {
+			return tag
+		}
+	}
+	return ""
+}
+
+// CleanupResult breaks down the tokens deleted by a cleanup by the criterion that
+// deleted them. clear used to return only the total.
+type CleanupResult struct {
+	TTL       int `json:"ttl"`
+	Deadline  int `json:"deadline"`
+	Idle      int `json:"idle"`
+	Tombstone int `json:"tombstone"`
+	Total     int `json:"total"`
+}
+
+// clearHandler sweeps expired tokens from all tokens tables. With the user or path
+// param it only sweeps the tokens of that user, or of the users under that path, in
+// the task's table, which requires @admin over them.
+func clearHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+	targets := allCleanupTargets()
+	user := ei.N(task.Params).M("user").StringZ()
+	path := ei.N(task.Params).M("path").StringZ()
+	if user != "" || path != "" {
+		if user != "" && path != "" {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Only one of user or path is allowed"}
+		}
+		allowed, err := hasPathTag(task, user+path)
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error getting effective tags: %v", err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+		if !allowed {
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrPermissionDenied}
+		}
+		targets = []cleanupTarget{{table: tableName(task), user: user, path: path}}
+	}
+
+	if ei.N(task.Params).M("dry_run").BoolZ() {
+		res, jerr := countExpiredTokens(targets)
+		if jerr != nil {
+			return nil, jerr
+		}
+		return res, nil
+	}
+	res, jerr := deleteExpiredTokens(targets)
+	if jerr != nil {
+		return nil, jerr
+	}
+	if user != "" || path != "" {
+		srv.Log(nxsugar.InfoLevel, "Expired tokens of %s cleared by %s: %d", user+path, task.User, res.Total)
+	}
+	return res, nil
+}
+
+// cleanupTarget is what a cleanup sweeps: a whole tokens table, or only the tokens
+// of user or of the users under path in it.
+type cleanupTarget struct {
+	table string
+	user  string
+	path  string
+}
+
+// allCleanupTargets returns a target for every tokens table.
+func allCleanupTargets() []cleanupTarget {
+	tables := tokenTables()
+	targets := make([]cleanupTarget, len(tables))
+	for i, table := range tables {
+		targets[i] = cleanupTarget{table: table}
+	}
+	return targets
+}
+
+// scoped reports whether t only covers some users.
+func (t cleanupTarget) scoped() bool {
+	return t.user != "" || t.path != ""
+}
+
+// tokens selects every token covered by t.
+func (t cleanupTarget) tokens() r.Term {
+	switch {
+	case t.user != "":
+		return r.Table(t.table).GetAllByIndex("user", t.user)
+	case t.path != "":
+		return underPath(r.Table(t.table), t.path)
+	}
+	return r.Table(t.table)
+}
+
+// exhaustedTokens selects tokens with no logins left, either out of ttl or having
+// reached their max_uses.
+func exhaustedTokens(t cleanupTarget) r.Term {
+	return withoutTombstones(t.tokens().Filter(r.Row.Field("ttl").Eq(0).Or(usesLeft(r.Row).Not())))
+}
+
+// pastDeadlineTokens selects tokens whose deadline has passed, through the deadline
+// index when sweeping whole tables.
+func pastDeadlineTokens(t cleanupTarget) r.Term {
+	if t.scoped() {
+		return withoutTombstones(t.tokens().Filter(r.Row.Field("deadline").Lt(r.Now())))
+	}
+	return withoutTombstones(r.Table(t.table).Between(r.MinVal, r.Now(), r.BetweenOpts{Index: "deadline"}))
+}
+
+// idleTokens selects tokens not seen for --idle-timeout. Tokens that never logged in
+// are idle since they were created. Tokens with neither field make the filter error
+// out and are kept.
+func idleTokens(t cleanupTarget) r.Term {
+	return withoutTombstones(t.tokens()).
+		Filter(r.Row.Field("lastSeen").Default(r.Row.Field("created")).Lt(r.Now().Sub(opts.IdleTimeout.Seconds())))
+}
+
+// countExpiredTokens reports how many tokens each cleanup criterion would delete
+// across targets, in the result a cleanup would return. A token may match more than
+// one criterion and is then counted under each, so Total may exceed what the cleanup
+// deletes.
+func countExpiredTokens(targets []cleanupTarget) (*CleanupResult, *nxsugar.JsonRpcErr) {
+	res := &CleanupResult{}
+	type criterion struct {
+		name      string
+		selection func(cleanupTarget) r.Term
+		count     *int
+	}
+	criteria := []criterion{
+		{"ttl", exhaustedTokens, &res.TTL},
+		{"deadline", pastDeadlineTokens, &res.Deadline},
+	}
+	if opts.IdleTimeout > 0 {
+		criteria = append(criteria, criterion{"idle", idleTokens, &res.Idle})
+	}
+	if opts.TombstoneRetention > 0 {
+		criteria = append(criteria, criterion{"tombstone", oldTombstones, &res.Tombstone})
+	}
+
+	for _, c := range criteria {
+		stmt := r.Expr(0)
+		for _, target := range targets {
+			stmt = stmt.Add(c.selection(target).Count())
+		}
+		cur, err := stmt.Run(db)
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error counting %s expired tokens. %v", c.name, err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+		err = cur.One(c.count)
+		cur.Close()
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error counting %s expired tokens. %v", c.name, err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+	}
+	res.Total = res.TTL + res.Deadline + res.Idle + res.Tombstone
+	return res, nil
+}
+
+// deleteExpiredTokensPeriodically sweeps expired tokens every --cleanup-interval until
+// stop is closed. Every wait is jittered so that instances restarted together don't
+// all hit RethinkDB at the same time.
+func deleteExpiredTokensPeriodically(stop <-chan struct{}) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	first := opts.CleanupInterval
+	if opts.CleanupDelay > 0 {
+		first = opts.CleanupDelay
+	}
+	t := time.NewTimer(cleanupDelay(rnd, first))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if !opts.CleanupLock || acquireCleanupLock() {
+				deleteExpiredTokens(allCleanupTargets())
+			}
+			t.Reset(cleanupDelay(rnd, opts.CleanupInterval))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// cleanupDelay spreads d randomly by up to --cleanup-jitter of the cleanup interval
+// either way.
+func cleanupDelay(rnd *rand.Rand, d time.Duration) time.Duration {
+	spread := time.Duration(opts.CleanupJitter * float64(opts.CleanupInterval))
+	if spread <= 0 {
+		return d
+	}
+	d += time.Duration(rnd.Int63n(int64(2*spread))) - spread
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// deleteExpiredTokens deletes the tokens matching each cleanup criterion from
+// targets, in turn.
+func deleteExpiredTokens(targets []cleanupTarget) (*CleanupResult, *nxsugar.JsonRpcErr) {
+	res := &CleanupResult{}
+	for _, target := range targets {
+		table := target.table
+		n, err := deleteInBatches(exhaustedTokens(target))
+		res.TTL += n
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error deleting exhausted tokens from %s. %v", table, err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+
+		n, err = deleteInBatches(pastDeadlineTokens(target))
+		res.Deadline += n
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error deleting expired tokens from %s. %v", table, err)
+			return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+
+		if opts.IdleTimeout > 0 {
+			n, err = deleteInBatches(idleTokens(target))
+			res.Idle += n
+			if err != nil {
+				srv.Log(nxsugar.ErrorLevel, "Error deleting idle tokens from %s. %v", table, err)
+				return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+			}
+		}
+
+		if opts.TombstoneRetention > 0 {
+			n, err = deleteInBatches(oldTombstones(target))
+			res.Tombstone += n
+			if err != nil {
+				srv.Log(nxsugar.ErrorLevel, "Error deleting tombstones from %s. %v", table, err)
+				return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+			}
+		}
+	}
+	res.Total = res.TTL + res.Deadline + res.Idle + res.Tombstone
+	recordCleanup(res)
+	srv.Log(nxsugar.InfoLevel, "Tokens deleted: %d with no more ttl, %d expired, %d idle, %d tombstones", res.TTL, res.Deadline, res.Idle, res.Tombstone)
+	return res, nil
+}
+
+// deleteInBatches deletes the tokens selected by stmt --cleanup-batch-size at a time,
+// so a large backlog never turns into a single huge delete, and returns how many were
+// deleted, including those deleted before an error.
+func deleteInBatches(stmt r.Term) (int, error) {
+	deleted := 0
+	for {
+		ret, err := stmt.Limit(opts.CleanupBatchSize).Delete().RunWrite(db)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += ret.Deleted
+		if ret.Deleted < opts.CleanupBatchSize {
+			return deleted, nil
+		}
 	}
-	countTokensDeleted += len(ret.Changes)
-	srv.Log(nxsugar.ErrorLevel, "Tokens expired deleted: %v", countTokensDeleted)
-	return countTokensDeleted, nil
 }
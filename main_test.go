@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// The task has no connection and db is nil, so if the handler went on to query the
+// limiter, the cache or RethinkDB with a malformed token the test would panic.
+func TestLoginRejectsMalformedTokens(t *testing.T) {
+	cases := map[string]interface{}{
+		"missing":   nil,
+		"empty":     "",
+		"oversized": strings.Repeat("a", maxTokenLength+1),
+		"number":    42,
+		"object":    map[string]interface{}{"token": "x"},
+	}
+	for name, token := range cases {
+		params := map[string]interface{}{}
+		if token != nil {
+			params["token"] = token
+		}
+		res, jerr := loginHandler(&nxsugar.Task{Params: params})
+		if res != nil {
+			t.Errorf("%s token: got %v, want no result", name, res)
+		}
+		if jerr == nil || jerr.Cod != nxsugar.ErrInvalidParams {
+			t.Errorf("%s token: got error %v, want code %d", name, jerr, nxsugar.ErrInvalidParams)
+		}
+	}
+}
+
+// list and info accept the same tags: each of listTags, or @admin, grants access on
+// its own and the narrowest one held is reported.
+func TestListTagsGrantAccess(t *testing.T) {
+	cases := []struct {
+		held []string
+		want string
+	}{
+		{held: []string{listTag}, want: listTag},
+		{held: []string{legacyListTag}, want: legacyListTag},
+		{held: []string{"@admin"}, want: "@admin"},
+		{held: []string{listTag, legacyListTag, "@admin"}, want: listTag},
+		{held: []string{legacyListTag, "@admin"}, want: legacyListTag},
+		{held: []string{"@sys.login.token.revoke"}, want: ""},
+		{held: nil, want: ""},
+	}
+	for _, c := range cases {
+		tags := map[string]interface{}{}
+		for _, tag := range c.held {
+			tags[tag] = true
+		}
+		res := map[string]interface{}{"tags": tags}
+		if got := heldTag(res, listTags...); got != c.want {
+			t.Errorf("holding %v: got %q, want %q", c.held, got, c.want)
+		}
+	}
+
+	// A tag explicitly denied over the path grants nothing.
+	res := map[string]interface{}{"tags": map[string]interface{}{listTag: false}}
+	if got := heldTag(res, listTags...); got != "" {
+		t.Errorf("holding %s=false: got %q, want none", listTag, got)
+	}
+}
+
+// Path filters cover the path and the users below it, never siblings sharing its
+// prefix, and treat the path literally. RethinkDB matches with RE2 like regexp.
+func TestUserPathPattern(t *testing.T) {
+	cases := []struct {
+		path  string
+		user  string
+		under bool
+	}{
+		{"root.foo", "root.foo", true},
+		{"root.foo", "root.foo.bar", true},
+		{"root.foo", "root.foobar", false},
+		{"root.foo", "root.fo", false},
+		{"root.foo", "rootXfoo", false},
+		{"root.foo", "rootXfoo.bar", false},
+		{"root", "root.foo", true},
+		{"root", "rootfoo", false},
+		{"a+b", "a+b.c", true},
+		{"a+b", "aab.c", false},
+	}
+	for _, c := range cases {
+		re := regexp.MustCompile(userPathPattern(c.path))
+		if got := re.MatchString(c.user); got != c.under {
+			t.Errorf("%s under %s: got %v, want %v", c.user, c.path, got, c.under)
+		}
+	}
+}
+
+// Guessing short OTP codes spreads failures over many codes, so they are capped per
+// tenant on top of per code, while full tokens only ever block themselves.
+func TestShortOTPFailuresCappedPerTenant(t *testing.T) {
+	saved, savedLimiter, savedOTPLimiter := opts, limiter, otpLimiter
+	defer func() { opts, limiter, otpLimiter = saved, savedLimiter, savedOTPLimiter }()
+	opts.OTPLength = 6
+	opts.LoginFailureWindow = time.Minute
+	opts.LoginCooldown = time.Minute
+	limiter = newLoginLimiter(3)
+	otpLimiter = newLoginLimiter(5)
+
+	task := &nxsugar.Task{Params: map[string]interface{}{}}
+	other := &nxsugar.Task{Params: map[string]interface{}{"tenant": "other"}}
+	for i := 0; i < 5; i++ {
+		code := fmt.Sprintf("%06d", i)
+		if loginBlocked(task, code, code) {
+			t.Fatalf("guess %d blocked before reaching the cap", i)
+		}
+		loginFailed(task, code, code)
+	}
+	if !loginBlocked(task, "123456", "123456") {
+		t.Error("short OTP logins not blocked after the tenant cap")
+	}
+	if loginBlocked(other, "123456", "123456") {
+		t.Error("short OTP logins blocked in another tenant")
+	}
+	token := strings.Repeat("a", 36)
+	if loginBlocked(task, token, token) {
+		t.Error("full token blocked by the short OTP cap")
+	}
+	for i := 0; i < 3; i++ {
+		loginFailed(task, token, token)
+	}
+	if !loginBlocked(task, token, token) {
+		t.Error("full token not blocked after its own failures")
+	}
+}
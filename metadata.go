@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// With --metadata-key, token metadata is stored encrypted with AES-256-GCM as an
+// envelope holding the version of the key used and the base64 nonce and ciphertext.
+// The first key encrypts; the others are only used to decrypt tokens stored before
+// a rotation. RethinkDB can't look into encrypted metadata, so the methods matching
+// on it are unavailable while encryption is on.
+const (
+	encVersionField = "_enc_v"
+	encDataField    = "_enc"
+)
+
+var metadataKeys struct {
+	current int
+	aeads   map[int]cipher.AEAD
+}
+
+// loadMetadataKeys parses the version:base64key entries of --metadata-key.
+func loadMetadataKeys(entries []string) error {
+	metadataKeys.aeads = make(map[int]cipher.AEAD, len(entries))
+	for i, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("metadata key %d must be version:base64key", i+1)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || version < 1 {
+			return fmt.Errorf("metadata key %d has an invalid version", i+1)
+		}
+		if _, ok := metadataKeys.aeads[version]; ok {
+			return fmt.Errorf("metadata key version %d is repeated", version)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("metadata key %d must be 32 base64 encoded bytes", version)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			metadataKeys.current = version
+		}
+		metadataKeys.aeads[version] = aead
+	}
+	return nil
+}
+
+// metadataEncrypted reports whether metadata is stored encrypted.
+func metadataEncrypted() bool {
+	return len(metadataKeys.aeads) > 0
+}
+
+// errMetadataEncrypted is returned by the methods that query metadata in RethinkDB.
+func errMetadataEncrypted() *nxsugar.JsonRpcErr {
+	return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Not available with metadata encryption"}
+}
+
+// reservedMetadata rejects metadata holding the fields of the encryption envelope,
+// which would be taken for encrypted metadata.
+func reservedMetadata(metadata interface{}) *nxsugar.JsonRpcErr {
+	m, _ := metadata.(map[string]interface{})
+	for _, field := range []string{encVersionField, encDataField} {
+		if _, ok := m[field]; ok {
+			return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("Metadata field %s is reserved", field)}
+		}
+	}
+	return nil
+}
+
+// encryptMetadata seals metadata with the current key. Without keys, or for tokens
+// without metadata, it is returned as is.
+func encryptMetadata(metadata interface{}) (interface{}, error) {
+	if !metadataEncrypted() || metadata == nil {
+		return metadata, nil
+	}
+	plain, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	aead := metadataKeys.aeads[metadataKeys.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+	return ei.M{
+		encVersionField: metadataKeys.current,
+		encDataField:    base64.StdEncoding.EncodeToString(sealed),
+	}, nil
+}
+
+// decryptMetadata opens the metadata of doc in place if it is encrypted. Metadata
+// that isn't an envelope, e.g. stored before encryption was enabled, is left as is,
+// and so is all metadata while encryption is off.
+func decryptMetadata(doc interface{}) error {
+	m, ok := doc.(map[string]interface{})
+	if !ok || !metadataEncrypted() {
+		return nil
+	}
+	data, err := ei.N(m).M("metadata").M(encDataField).String()
+	if err != nil {
+		return nil
+	}
+	version := ei.N(m).M("metadata").M(encVersionField).IntZ()
+	aead, ok := metadataKeys.aeads[version]
+	if !ok {
+		return fmt.Errorf("unknown metadata key version %d", version)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return errors.New("encrypted metadata is too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return err
+	}
+	var metadata interface{}
+	if err := json.Unmarshal(plain, &metadata); err != nil {
+		return err
+	}
+	m["metadata"] = metadata
+	return nil
+}
+
+// decryptTokens decrypts the metadata of every token in docs, failing on the first
+// one that can't be decrypted.
+func decryptTokens(docs []interface{}) *nxsugar.JsonRpcErr {
+	for _, doc := range docs {
+		if err := decryptMetadata(doc); err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error decrypting token metadata: %v", err)
+			return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+		}
+	}
+	return nil
+}
+
+// decryptedToken returns doc, as returned by a write, with its metadata decrypted.
+func decryptedToken(doc interface{}) (interface{}, *nxsugar.JsonRpcErr) {
+	if jerr := decryptTokens([]interface{}{doc}); jerr != nil {
+		return nil, jerr
+	}
+	return doc, nil
+}
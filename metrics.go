@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/nayarsystems/nxsugar-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// liveTokensRefreshInterval is how often the live tokens gauge is recomputed.
+const liveTokensRefreshInterval = 30 * time.Second
+
+var (
+	handlerCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "token_auth",
+		Name:      "calls_total",
+		Help:      "Method invocations by result.",
+	}, []string{"method", "result"})
+	handlerLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "token_auth",
+		Name:      "call_duration_seconds",
+		Help:      "Method latency.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	liveTokens = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "token_auth",
+		Name:      "live_tokens",
+		Help:      "Tokens in the default table that can still be used to log in.",
+	})
+)
+
+func instrument(name string, h handler) handler {
+	return func(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+		start := time.Now()
+		res, jerr := h(task)
+		handlerLatency.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		result := "ok"
+		if jerr != nil {
+			result = "error"
+		}
+		handlerCalls.WithLabelValues(name, result).Inc()
+		return res, jerr
+	}
+}
+
+// serveMetrics exposes the Prometheus endpoint on --metrics-addr.
+func serveMetrics() {
+	prometheus.MustRegister(handlerCalls, handlerLatency, liveTokens)
+	go refreshLiveTokens()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(opts.MetricsAddr, mux); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error serving metrics: %v", err)
+	}
+}
+
+func refreshLiveTokens() {
+	for ; ; time.Sleep(liveTokensRefreshInterval) {
+		cur, err := activeTokens(r.Table(defaultTable)).Count().Run(db)
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error counting live tokens: %v", err)
+			continue
+		}
+		var count int
+		err = cur.One(&count)
+		cur.Close()
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error counting live tokens: %v", err)
+			continue
+		}
+		liveTokens.Set(float64(count))
+	}
+}
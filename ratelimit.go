@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// loginLimiter counts failed logins per key over a sliding window and blocks a key
+// for a cooldown period once it reaches max failures.
+type loginLimiter struct {
+	sync.Mutex
+	max      int
+	failures map[string][]time.Time
+	blocked  map[string]time.Time
+}
+
+// limiter tracks failed logins per token, otpLimiter failed short OTP logins per
+// tenant.
+var limiter, otpLimiter *loginLimiter
+
+func newLoginLimiter(max int) *loginLimiter {
+	l := &loginLimiter{
+		max:      max,
+		failures: make(map[string][]time.Time),
+		blocked:  make(map[string]time.Time),
+	}
+	go l.sweep()
+	return l
+}
+
+// allowed reports whether none of keys is currently blocked.
+func (l *loginLimiter) allowed(keys ...string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if until, ok := l.blocked[key]; ok && now.Before(until) {
+			return false
+		}
+	}
+	return true
+}
+
+// fail records a failed login for each of keys, blocking those that reach the limit.
+func (l *loginLimiter) fail(keys ...string) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		recent := append(recentFailures(l.failures[key], now), now)
+		if len(recent) >= l.max {
+			l.blocked[key] = now.Add(opts.LoginCooldown)
+			delete(l.failures, key)
+			continue
+		}
+		l.failures[key] = recent
+	}
+}
+
+// reset forgets the failures of key after a successful login.
+func (l *loginLimiter) reset(key string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.failures, key)
+	delete(l.blocked, key)
+}
+
+// sweep periodically drops failures outside the window and expired blocks.
+func (l *loginLimiter) sweep() {
+	for range time.Tick(opts.LoginFailureWindow) {
+		l.Lock()
+		now := time.Now()
+		for key, times := range l.failures {
+			if recent := recentFailures(times, now); len(recent) > 0 {
+				l.failures[key] = recent
+			} else {
+				delete(l.failures, key)
+			}
+		}
+		for key, until := range l.blocked {
+			if !now.Before(until) {
+				delete(l.blocked, key)
+			}
+		}
+		l.Unlock()
+	}
+}
+
+func recentFailures(times []time.Time, now time.Time) []time.Time {
+	start := now.Add(-opts.LoginFailureWindow)
+	for i, t := range times {
+		if t.After(start) {
+			return times[i:]
+		}
+	}
+	return times[:0]
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// reconnects counts the RethinkDB reconnections, so that handlers failing while
+// another one reconnected can tell and retry without reconnecting again. It is read
+// atomically on every call; reconnecting serializes the attempts to reconnect, which
+// may back off for a while, without holding up calls that don't fail.
+var (
+	reconnects   int64
+	reconnecting sync.Mutex
+)
+
+// withReconnect checks the RethinkDB session when h fails with an internal error and
+// reconnects it if the connection was lost. Read methods are then retried once; the
+// others aren't, as their first attempt may have been applied before the connection
+// dropped and running them again could e.g. consume a login twice.
+func withReconnect(name string, h handler) handler {
+	return func(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+		count := atomic.LoadInt64(&reconnects)
+
+		res, jerr := h(task)
+		if jerr == nil || jerr.Cod != nxsugar.ErrInternal {
+			return res, jerr
+		}
+		if !dbRecover(count) || !readMethods[name] {
+			return res, jerr
+		}
+		return h(task)
+	}
+}
+
+// dbRecover reconnects the RethinkDB session if its connection was lost, and reports
+// whether it was reconnected since count was read.
+func dbRecover(count int64) bool {
+	if atomic.LoadInt64(&reconnects) != count {
+		return true
+	}
+	reconnecting.Lock()
+	defer reconnecting.Unlock()
+	if atomic.LoadInt64(&reconnects) != count {
+		return true
+	}
+	err := dbPing()
+	if err == nil || !isConnErr(err) {
+		return false
+	}
+	srv.Log(nxsugar.WarnLevel, "Lost connection with RethinkDB, reconnecting: %v", err)
+	if err := dbRetry("reconnecting to", func() error { return db.Reconnect() }); err != nil {
+		srv.Log(nxsugar.ErrorLevel, "Error reconnecting to RethinkDB: %v", err)
+		return false
+	}
+	atomic.AddInt64(&reconnects, 1)
+	return true
+}
+
+// dbError logs a failed query and returns the error for the caller: errUnavailable
+// while RethinkDB can't serve the table, e.g. during a rebalance, so clients back off
+// and retry, and an internal error otherwise.
+func dbError(err error) *nxsugar.JsonRpcErr {
+	if isAvailabilityErr(err) {
+		srv.Log(nxsugar.WarnLevel, "RethinkDB unavailable: %v", err)
+		return &nxsugar.JsonRpcErr{Cod: errUnavailable, Mess: "Database temporarily unavailable, retry later"}
+	}
+	srv.Log(nxsugar.ErrorLevel, "Error: %v", err)
+	return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+}
+
+// isAvailabilityErr reports whether err is RethinkDB failing an operation because the
+// table or its primary replicas are unavailable for the moment.
+func isAvailabilityErr(err error) bool {
+	switch err.(type) {
+	case r.RQLAvailabilityError, r.RQLOpFailedError, r.RQLOpIndeterminateError:
+		return true
+	}
+	return false
+}
+
+// isConnErr reports whether err means the connection to RethinkDB is gone, as
+// opposed to a failing query.
+func isConnErr(err error) bool {
+	switch err {
+	case r.ErrConnectionClosed, r.ErrNoConnections, r.ErrNoConnectionsStarted:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
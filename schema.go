@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nayarsystems/nxsugar-go"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// metadataSchema is the JSON schema token metadata must conform to, set through
+// metadata_schema in the tokenauth config section. Without it any object is accepted.
+var metadataSchema *gojsonschema.Schema
+
+// loadMetadataSchema compiles the metadata_schema of the config file.
+func loadMetadataSchema(raw json.RawMessage) error {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(raw))
+	if err != nil {
+		return fmt.Errorf("invalid metadata_schema: %v", err)
+	}
+	metadataSchema = schema
+	return nil
+}
+
+// validateMetadata checks metadata against metadataSchema, if any. It runs before
+// encryption, on the metadata as it will be stored; missing metadata is validated as
+// an empty object so that required fields are enforced too.
+func validateMetadata(metadata interface{}) *nxsugar.JsonRpcErr {
+	if metadataSchema == nil {
+		return nil
+	}
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	res, err := metadataSchema.Validate(gojsonschema.NewGoLoader(metadata))
+	if err != nil {
+		return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: fmt.Sprintf("Metadata can't be validated: %v", err)}
+	}
+	if res.Valid() {
+		return nil
+	}
+	errs := make([]string, len(res.Errors()))
+	for i, e := range res.Errors() {
+		errs[i] = e.String()
+	}
+	return &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Metadata doesn't match the schema: " + strings.Join(errs, "; ")}
+}
+
+// mergedMetadata returns the metadata a metadata_merge would leave, merging nested
+// objects like RethinkDB does, so it can be validated before the update.
+func mergedMetadata(metadata interface{}, merge interface{}) interface{} {
+	old, ok := metadata.(map[string]interface{})
+	patch, ok2 := merge.(map[string]interface{})
+	if !ok || !ok2 {
+		return merge
+	}
+	merged := make(map[string]interface{}, len(old)+len(patch))
+	for k, v := range old {
+		merged[k] = v
+	}
+	for k, v := range patch {
+		merged[k] = mergedMetadata(merged[k], v)
+	}
+	return merged
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// cleanupTotals accumulates the tokens deleted by this instance's cleanups since
+// it started, for the periodic stats line.
+var cleanupTotals struct {
+	sync.Mutex
+	CleanupResult
+}
+
+// recordCleanup adds the tokens deleted by a cleanup to cleanupTotals.
+func recordCleanup(res *CleanupResult) {
+	cleanupTotals.Lock()
+	defer cleanupTotals.Unlock()
+	cleanupTotals.TTL += res.TTL
+	cleanupTotals.Deadline += res.Deadline
+	cleanupTotals.Idle += res.Idle
+	cleanupTotals.Tombstone += res.Tombstone
+	cleanupTotals.Total += res.Total
+}
+
+// logStatsPeriodically logs the token statistics of all tokens tables every
+// --stats-interval until stop is closed, giving some visibility to deployments
+// without Prometheus.
+func logStatsPeriodically(stop <-chan struct{}) {
+	t := time.NewTicker(opts.StatsInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			logStats()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func logStats() {
+	var total, active, exhausted, pastDeadline int
+	for _, table := range tokenTables() {
+		stats, err := tokenStats(r.Table(table))
+		if err != nil {
+			srv.Log(nxsugar.ErrorLevel, "Error getting token stats of %s: %v", table, err)
+			return
+		}
+		total += stats.Total
+		active += stats.Active
+		exhausted += stats.Exhausted
+		pastDeadline += stats.PastDeadline
+	}
+
+	cleanupTotals.Lock()
+	cleaned := cleanupTotals.CleanupResult
+	cleanupTotals.Unlock()
+
+	srv.Log(nxsugar.InfoLevel, "Token stats: total=%d active=%d expired=%d exhausted=%d past_deadline=%d cleaned=%d cleaned_ttl=%d cleaned_deadline=%d cleaned_idle=%d cleaned_tombstone=%d",
+		total, active, total-active, exhausted, pastDeadline, cleaned.Total, cleaned.TTL, cleaned.Deadline, cleaned.Idle, cleaned.Tombstone)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// defaultTable holds the tokens of requests without a tenant param. Each tenant
+// allowed with --tenant gets its own table, created on startup.
+const defaultTable = "tokens"
+
+var tenantNameRe = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+var tables = struct {
+	sync.Mutex
+	ready map[string]bool
+}{ready: map[string]bool{}}
+
+// tableName returns the name of the tokens table the task operates on.
+func tableName(task *nxsugar.Task) string {
+	if tenant := ei.N(task.Params).M("tenant").StringZ(); tenant != "" {
+		return tenantTable(tenant)
+	}
+	return defaultTable
+}
+
+// tenantTable returns the name of the tokens table of tenant.
+func tenantTable(tenant string) string {
+	return defaultTable + "_" + tenant
+}
+
+// tokensTable returns the tokens table the task operates on.
+func tokensTable(task *nxsugar.Task) r.Term {
+	return r.Table(tableName(task))
+}
+
+// withTenant rejects tasks for unknown tenants and makes sure the tenant's table
+// exists before h runs.
+func withTenant(h handler) handler {
+	return func(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+		if tenant := ei.N(task.Params).M("tenant").StringZ(); tenant != "" {
+			if !inStrSlice(opts.Tenants, tenant) {
+				return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInvalidParams, Mess: "Unknown tenant"}
+			}
+			if err := ensureTable(tableName(task)); err != nil {
+				srv.Log(nxsugar.ErrorLevel, "Error bootstrapping tenant %s. %v", tenant, err)
+				return nil, &nxsugar.JsonRpcErr{Cod: nxsugar.ErrInternal}
+			}
+		}
+		return h(task)
+	}
+}
+
+// ensureTable bootstraps the named tokens table once.
+func ensureTable(name string) error {
+	tables.Lock()
+	defer tables.Unlock()
+	if tables.ready[name] {
+		return nil
+	}
+	if err := bootstrapTable(name); err != nil {
+		return err
+	}
+	tables.ready[name] = true
+	// Tables bootstrapped before the service exists get their feed from main.
+	if opts.EventsTopic != "" && srv != nil {
+		go watchTokenEvents(name)
+	}
+	return nil
+}
+
+// tokenTables returns the names of all bootstrapped tokens tables.
+func tokenTables() []string {
+	tables.Lock()
+	defer tables.Unlock()
+	names := make([]string, 0, len(tables.ready))
+	for name := range tables.ready {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// withTimeout answers with errQueryTimeout when the read method name runs longer than
+// --query-timeout, so a stuck RethinkDB doesn't tie up the nexus worker serving the
+// task. The driver has no way to cancel a query, so h keeps running in the background
+// and its result is dropped. Methods that write aren't wrapped: they would report a
+// failure for a write that may still be applied.
+func withTimeout(name string, h handler) handler {
+	if opts.QueryTimeout <= 0 || !readMethods[name] {
+		return h
+	}
+	type result struct {
+		res  interface{}
+		jerr *nxsugar.JsonRpcErr
+	}
+	return func(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+		done := make(chan result, 1)
+		go func() {
+			res, jerr := h(task)
+			done <- result{res, jerr}
+		}()
+		timer := time.NewTimer(opts.QueryTimeout)
+		defer timer.Stop()
+		select {
+		case ret := <-done:
+			return ret.res, ret.jerr
+		case <-timer.C:
+			srv.Log(nxsugar.WarnLevel, "%s timed out after %v", name, opts.QueryTimeout)
+			return nil, &nxsugar.JsonRpcErr{Cod: errQueryTimeout, Mess: "Database query timed out"}
+		}
+	}
+}
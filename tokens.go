@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/jaracil/ei"
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// hashAlg identifies how a token's primary key was derived from its secret.
+// It is stored in the "alg" field of hashed tokens so that future migrations
+// can tell hashed and raw tokens apart.
+const hashAlg = "sha256"
+
+// newSecret returns a high-entropy token secret suitable for handing out to clients.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// crockford is the base32 alphabet of ULIDs, which sorts like the values it encodes.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48 bits of milliseconds since the epoch followed by 80
+// random bits, as 26 characters that sort by creation time.
+func newULID(t time.Time) (string, error) {
+	var b [16]byte
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> uint(8*(5-i)))
+	}
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	// 128 bits are 26 characters of 5 bits with 2 spare leading bits.
+	id := make([]byte, 26)
+	n := new(big.Int).SetBytes(b[:])
+	mask := big.NewInt(31)
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockford[new(big.Int).And(n, mask).Int64()]
+		n.Rsh(n, 5)
+	}
+	return string(id), nil
+}
+
+// ulidSuffixLength is the number of random characters appended to ULID tokens: the 80
+// random bits of a ULID alone are fewer than the 122 of a UUID, and its other 48 are
+// the creation time, which any holder of the token can read.
+const ulidSuffixLength = 16
+
+// newULIDSecret returns a ULID for time t followed by ulidSuffixLength random
+// characters of the same alphabet, 160 random bits in all. It still sorts by t.
+func newULIDSecret(t time.Time) (string, error) {
+	id, err := newULID(t)
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, ulidSuffixLength)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	for i := range suffix {
+		suffix[i] = crockford[suffix[i]&31]
+	}
+	return id + string(suffix), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenKey maps a token supplied by a client to the primary key it is stored under.
+// With --hash-tokens enabled, tokens issued before it was turned on can no longer be found.
+func tokenKey(token string) string {
+	if !opts.HashTokens {
+		return token
+	}
+	return hashToken(token)
+}
+
+// tokenMatches checks that doc was stored for token. Hashed documents are compared
+// in constant time; raw documents were already matched by the primary key lookup.
+func tokenMatches(doc interface{}, token string) bool {
+	if ei.N(doc).M("alg").StringZ() != hashAlg {
+		return true
+	}
+	id := ei.N(doc).M("id").StringZ()
+	return subtle.ConstantTimeCompare([]byte(id), []byte(hashToken(token))) == 1
+}
+
+// insertToken stores a new token document and returns the token to hand to the client.
+func insertToken(task *nxsugar.Task, doc ei.M) (string, error) {
+	tokens, err := insertTokens(task, []ei.M{doc})
+	if err != nil {
+		return "", err
+	}
+	return tokens[0], nil
+}
+
+// newTokenSecret returns the secret of a new token, or an empty one to let RethinkDB
+// generate a UUID key. Secrets are generated here when hashing, as they are only
+// returned and never stored; with --token-prefix, as RethinkDB generated keys can't
+// carry the prefix; and with --token-ids=ulid.
+func newTokenSecret() (string, error) {
+	var secret string
+	var err error
+	switch {
+	case opts.TokenIDs == "ulid":
+		secret, err = newULIDSecret(time.Now())
+	case opts.HashTokens || opts.TokenPrefix != "":
+		secret, err = newSecret()
+	default:
+		return "", nil
+	}
+	return opts.TokenPrefix + secret, err
+}
+
+// insertTokens stores new token documents in the task's table in a single query
+// and returns the tokens to hand to the client, in the same order as docs.
+func insertTokens(task *nxsugar.Task, docs []ei.M) ([]string, error) {
+	secrets := make([]string, len(docs))
+	for i := range secrets {
+		secret, err := newTokenSecret()
+		if err != nil {
+			return nil, err
+		}
+		secrets[i] = secret
+	}
+	return storeTokens(task, docs, secrets)
+}
+
+// writeError is an error RethinkDB reported for the documents of a write whose
+// query itself succeeded, e.g. a duplicate primary key.
+type writeError string
+
+func (e writeError) Error() string {
+	return string(e)
+}
+
+// storeTokens stores docs under the given secrets, letting RethinkDB generate the
+// key of those with an empty one. The creation time is recorded in the "created"
+// field unless already set; tokens issued by older versions lack it and their
+// creation time is unknown.
+func storeTokens(task *nxsugar.Task, docs []ei.M, secrets []string) ([]string, error) {
+	tokens := make([]string, len(docs))
+	for i, doc := range docs {
+		if _, ok := doc["created"]; !ok {
+			doc["created"] = r.Now()
+		}
+		if secrets[i] != "" {
+			tokens[i] = secrets[i]
+			doc["id"] = tokenKey(secrets[i])
+			if opts.HashTokens {
+				doc["alg"] = hashAlg
+			}
+		}
+	}
+
+	ret, err := tokensTable(task).Insert(docs).RunWrite(db)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Errors > 0 {
+		return nil, writeError(ret.FirstError)
+	}
+	generated := ret.GeneratedKeys
+	for i := range tokens {
+		if tokens[i] != "" {
+			continue
+		}
+		if len(generated) == 0 {
+			return nil, writeError("no key generated")
+		}
+		tokens[i], generated = generated[0], generated[1:]
+	}
+	return tokens, nil
+}
+
+// otpCharsets are the characters short OTP codes can be drawn from.
+var otpCharsets = map[string]string{
+	"numeric":      "0123456789",
+	"alphanumeric": "ABCDEFGHJKLMNPQRSTUVWXYZ23456789",
+}
+
+// otpRetries bounds how many OTPs are tried when they collide with existing tokens.
+const otpRetries = 5
+
+// newOTPCode returns a random --otp-length code drawn from --otp-charset.
+func newOTPCode() (string, error) {
+	charset := otpCharsets[opts.OTPCharset]
+	max := big.NewInt(int64(len(charset)))
+	code := make([]byte, opts.OTPLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = charset[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// newOTPSecret returns the secret of a new OTP: a short code with --otp-length, or
+// else that of a regular token.
+func newOTPSecret() (string, error) {
+	if opts.OTPLength > 0 {
+		return newOTPCode()
+	}
+	return newTokenSecret()
+}
+
+// insertOTP stores an OTP token document. With --otp-length set the token is a
+// short human readable code; otherwise it is a regular token. Either way a token
+// colliding with an existing one is regenerated, up to otpRetries times.
+//
+// Short codes are the primary key of the document like any token, so they share a
+// small space across all users and login caps their failures per tenant as well.
+// They don't carry --token-prefix, and with --hash-tokens their unsalted hashes are
+// trivially reversed by hashing every possible code.
+func insertOTP(task *nxsugar.Task, doc ei.M) (string, error) {
+	for attempt := 1; attempt <= otpRetries; attempt++ {
+		secret, err := newOTPSecret()
+		if err != nil {
+			return "", err
+		}
+		tokens, err := storeTokens(task, []ei.M{doc}, []string{secret})
+		if err == nil {
+			return tokens[0], nil
+		}
+		if !duplicateKey(err) {
+			return "", err
+		}
+		delete(doc, "id")
+	}
+	return "", writeError(fmt.Sprintf("No free OTP found after %d attempts", otpRetries))
+}
+
+// duplicateKey reports whether err is RethinkDB rejecting an insert because the
+// primary key is taken.
+func duplicateKey(err error) bool {
+	_, ok := err.(writeError)
+	return ok && strings.HasPrefix(err.Error(), "Duplicate primary key")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	r "github.com/dancannon/gorethink"
+	"github.com/jaracil/ei"
+)
+
+// With --tombstone-retention, consumed and revoked tokens are kept as tombstones for
+// that long before the cleanup sweep deletes them, so there is a record of when they
+// were used. A tombstone has a status, the time it was set in consumedAt or revokedAt,
+// and no ttl left so it can't log in again.
+
+// tombstone returns the update turning a token into a tombstone with status.
+func tombstone(status string) ei.M {
+	return ei.M{"ttl": 0, "status": status, status + "At": r.Now()}
+}
+
+// revocation returns the update revoking a token, which leaves a tombstone when
+// they are retained.
+func revocation() ei.M {
+	update := ei.M{"ttl": 0, "deadline": r.Now()}
+	if opts.TombstoneRetention > 0 {
+		for k, v := range tombstone("revoked") {
+			update[k] = v
+		}
+	}
+	return update
+}
+
+// tombstoned reports whether doc is a tombstone.
+func tombstoned(doc interface{}) bool {
+	return ei.N(doc).M("status").StringZ() != ""
+}
+
+// withoutTombstones filters retained tombstones out of stmt. Without retention
+// tombstones are swept like any other expired token.
+func withoutTombstones(stmt r.Term) r.Term {
+	if opts.TombstoneRetention <= 0 {
+		return stmt
+	}
+	return stmt.Filter(r.Row.HasFields("status").Not())
+}
+
+// oldTombstones selects tombstones past --tombstone-retention.
+func oldTombstones(t cleanupTarget) r.Term {
+	return t.tokens().
+		Filter(r.Row.HasFields("status")).
+		Filter(r.Row.Field("consumedAt").Default(r.Row.Field("revokedAt")).Lt(r.Now().Sub(opts.TombstoneRetention.Seconds())))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/nayarsystems/nxsugar-go"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// VersionResponse identifies the build an instance runs.
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+func buildInfo() *VersionResponse {
+	return &VersionResponse{Version: version, Commit: commit, BuildDate: buildDate}
+}
+
+// versionHandler returns the build of this instance, e.g. to check that a rollout
+// reached every instance.
+func versionHandler(task *nxsugar.Task) (interface{}, *nxsugar.JsonRpcErr) {
+	return buildInfo(), nil
+}